@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/aemengo/snb/parser"
+)
+
+// failedStepVariable and exitCodeVariable describe the step that failed
+// the build to its cleanup steps
+const (
+	failedStepVariable = "SNB_FAILED_STEP"
+	exitCodeVariable   = "SNB_EXIT_CODE"
+)
+
+// cleanUp executes the cleanup steps of the spec once the build has ended
+// with the given error: the ON FAILURE steps when a step has failed,
+// followed by the FINALLY steps. The error of the build remains the
+// original one, unless the build only failed during its FINALLY steps.
+func (r *runner) cleanUp(err error) error {
+	var env []string
+	if failure, ok := err.(*stepFailure); ok {
+		env = []string{
+			failedStepVariable + "=" + failure.step.String(),
+			fmt.Sprintf("%s=%d", exitCodeVariable, failure.exitCode()),
+		}
+
+		r.runCleanup("On failure", r.spec.OnFailure, env)
+	}
+
+	finallyErr := r.runCleanup("Finally", r.spec.Finally, env)
+	if err != nil {
+		return err
+	}
+
+	return finallyErr
+}
+
+// runCleanup executes every one of the given cleanup steps, uncached and
+// regardless of whether the ones before them fail, and returns the
+// failure of the first one that does
+func (r *runner) runCleanup(label string, steps []parser.Step, env []string) error {
+	var failure error
+
+	for index, step := range steps {
+		out := newOutput(false)
+		out.printf(boldWhite, "%s %d/%d : %s\n", label, index+1, len(steps), step)
+
+		step.Env = append(append([]string(nil), step.Env...), env...)
+
+		timeout := step.Timeout
+		if timeout == 0 {
+			timeout = r.timeout
+		}
+
+		if _, err := executeAttempts(step, timeout, out); err != nil {
+			out.printf(red, logPrefix+"Failed (%s)\n", err)
+
+			if failure == nil {
+				failure = &stepFailure{step: step, err: err}
+			}
+		}
+	}
+
+	return failure
+}
@@ -4,9 +4,12 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"database/sql"
 	"github.com/aemengo/snb/fs"
+	"github.com/aemengo/snb/parser"
 	"github.com/jmoiron/sqlx"
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -30,23 +33,10 @@ func New(rootDir string) (*DB, error) {
 
 	sqlxDB := sqlx.NewDb(db, "sqlite3")
 
-	sqlxDB.MustExec(`
-	create table if not exists objects (
-	  id integer not null primary key,
-	  path text not null unique,
-	  sha text not null,
-	  updated_at timestamp default current_timestamp not null
-	);
-	`)
-
-	sqlxDB.MustExec(`
-	create table if not exists steps (
-	  id integer not null primary key,
-	  definition text not null,
-	  number integer not null unique,
-	  updated_at timestamp default current_timestamp not null
-	);
-	`)
+	if err := migrate(sqlxDB); err != nil {
+		sqlxDB.Close()
+		return nil, fmt.Errorf("Error migrating database at %s: %s", dbPath, err)
+	}
 
 	return &DB{
 		root: rootDir,
@@ -58,9 +48,15 @@ func (s *DB) Close() error {
 	return s.db.Close()
 }
 
-func (s *DB) IsCached(step string, index int, objects []fs.Object) (bool, error) {
+// IsCached reports whether a step can be skipped according to its cache
+// policy: by default when an earlier run with the same definition
+// observed the same checksums for the given objects
+func (s *DB) IsCached(step parser.Step, objects []fs.Object) (bool, error) {
 	var (
-		stepExists     = false
+		steps []struct {
+			ID        int       `db:"id"`
+			UpdatedAt time.Time `db:"updated_at"`
+		}
 		pathsFlags     = make([]bool, len(objects))
 		allPathsExists = func() bool {
 			if len(pathsFlags) == 0 {
@@ -77,39 +73,94 @@ func (s *DB) IsCached(step string, index int, objects []fs.Object) (bool, error)
 		}
 	)
 
-	err := s.db.Get(&stepExists, "select count(*) == 1 from steps where definition = ? and number = ? limit 1", step, index)
+	if step.Cache == parser.CacheNever {
+		return false, nil
+	}
+
+	err := s.db.Select(&steps, "select id, updated_at from steps where identity = ? and definition = ? limit 1", step.ID(), step.Definition())
 	if err != nil {
 		return false, err
 	}
 
+	if len(steps) == 0 {
+		return false, nil
+	}
+
+	if step.CacheTTL > 0 && time.Since(steps[0].UpdatedAt) > step.CacheTTL {
+		return false, nil
+	}
+
+	if step.Cache == parser.CacheAlways {
+		return true, nil
+	}
+
+	paths := map[string]bool{}
 	for index, obj := range objects {
-		err = s.db.Get(&pathsFlags[index], "select count(*) == 1 from objects where path = ? and sha = ? limit 1", obj.Path, obj.Sha)
+		err = s.db.Get(&pathsFlags[index], "select count(*) == 1 from step_inputs where step_id = ? and path = ? and sha = ? limit 1", steps[0].ID, obj.Path, obj.Sha)
 		if err != nil {
 			return false, err
 		}
+
+		paths[obj.Path] = true
+	}
+
+	// an object observed by the earlier run that is now gone, such as a
+	// file no longer matching a glob, has to be noticed as well
+	var recorded int
+	err = s.db.Get(&recorded, "select count(*) from step_inputs where step_id = ?", steps[0].ID)
+	if err != nil {
+		return false, err
 	}
 
-	return stepExists && allPathsExists(), nil
+	return allPathsExists() && recorded == len(paths), nil
 }
 
-func (s *DB) Save(step string, index int, objects []fs.Object) error {
-	_, err := s.db.Exec(`
-		insert or replace into steps
-		 (definition, number) VALUES
+// Save records the definition of a step along with the exact checksums
+// of the objects it observed, replacing those of any earlier run
+func (s *DB) Save(step parser.Step, objects []fs.Object) error {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		insert or ignore into steps
+		 (identity, definition) VALUES
 		 ($1, $2)`,
-		step, index,
+		step.ID(), step.Definition(),
 	)
+	if err != nil {
+		return err
+	}
 
+	_, err = tx.Exec(`
+		update steps
+		 set definition = $1, updated_at = current_timestamp
+		 where identity = $2`,
+		step.Definition(), step.ID(),
+	)
+	if err != nil {
+		return err
+	}
+
+	var stepID int
+	err = tx.Get(&stepID, "select id from steps where identity = ?", step.ID())
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("delete from step_inputs where step_id = ?", stepID)
 	if err != nil {
 		return err
 	}
 
 	for _, obj := range objects {
-		_, err := s.db.Exec(`
-		insert or replace into objects
-		  (path, sha) VALUES
-		  ($1, $2)`,
-			obj.Path, obj.Sha,
+		_, err := tx.Exec(`
+		insert or replace into step_inputs
+		  (step_id, path, sha) VALUES
+		  ($1, $2, $3)`,
+			stepID, obj.Path, obj.Sha,
 		)
 
 		if err != nil {
@@ -117,5 +168,60 @@ func (s *DB) Save(step string, index int, objects []fs.Object) error {
 		}
 	}
 
-	return nil
+	return tx.Commit()
+}
+
+// RecordAttempts records how many attempts the latest run of a saved step
+// took, counting the run as flaky when it took more than one
+func (s *DB) RecordAttempts(step parser.Step, attempts int) error {
+	flaky := 0
+	if attempts > 1 {
+		flaky = 1
+	}
+
+	_, err := s.db.Exec(`
+		update steps
+		 set attempts = $1, flaky_runs = flaky_runs + $2
+		 where identity = $3`,
+		attempts, flaky, step.ID(),
+	)
+	return err
+}
+
+// HasRun reports whether any earlier run of a step has been recorded,
+// regardless of its definition
+func (s *DB) HasRun(step parser.Step) (bool, error) {
+	var ran bool
+	err := s.db.Get(&ran, "select count(*) > 0 from steps where identity = ?", step.ID())
+	return ran, err
+}
+
+// FlakyRuns returns how many runs of a step took more than one attempt
+func (s *DB) FlakyRuns(step parser.Step) (int, error) {
+	var count int
+	err := s.db.Get(&count, "select coalesce(sum(flaky_runs), 0) from steps where identity = ?", step.ID())
+	return count, err
+}
+
+// SaveExports records the variables, in KEY=value form, that the latest
+// run of a saved step exported
+func (s *DB) SaveExports(step parser.Step, exports []string) error {
+	_, err := s.db.Exec(`
+		update steps
+		 set exports = $1
+		 where identity = $2`,
+		strings.Join(exports, "\n"), step.ID(),
+	)
+	return err
+}
+
+// Exports returns the variables that the latest run of a step exported
+func (s *DB) Exports(step parser.Step) ([]string, error) {
+	var exports []string
+	err := s.db.Select(&exports, "select exports from steps where identity = ?", step.ID())
+	if err != nil || len(exports) == 0 || exports[0] == "" {
+		return nil, err
+	}
+
+	return strings.Split(exports[0], "\n"), nil
 }
@@ -8,6 +8,11 @@ import (
 	"io/ioutil"
 	"os"
 	"github.com/aemengo/snb/fs"
+	"github.com/aemengo/snb/parser"
+	"database/sql"
+	"github.com/jmoiron/sqlx"
+	"path/filepath"
+	"time"
 )
 
 var _ = Describe("Store", func() {
@@ -32,7 +37,7 @@ var _ = Describe("Store", func() {
 
 	Describe("When nothing is saved to the store", func() {
 		It("returns false for cached steps", func() {
-			cached, err := dbClient.IsCached("some-step", 1, nil)
+			cached, err := dbClient.IsCached(parser.Step{Command: "some-step"}, nil)
 			Expect(err).NotTo(HaveOccurred())
 			Expect(cached).To(BeFalse())
 		})
@@ -40,7 +45,7 @@ var _ = Describe("Store", func() {
 
 	Describe("when steps are saved to the store", func() {
 		BeforeEach(func() {
-			err := dbClient.Save("some-step", 1, []fs.Object{
+			err := dbClient.Save(parser.Step{Command: "some-step"}, []fs.Object{
 				{Path: "./some-path-1", Sha: "abc-some-sha"},
 				{Path: "./some-path-2", Sha: "def-some-sha"},
 			})
@@ -50,7 +55,7 @@ var _ = Describe("Store", func() {
 
 		Context("when queried for step and matching objects", func() {
 			It("returns true for cached steps", func() {
-				cached, err := dbClient.IsCached("some-step", 1, []fs.Object{
+				cached, err := dbClient.IsCached(parser.Step{Command: "some-step"}, []fs.Object{
 					{Path: "./some-path-1", Sha: "abc-some-sha"},
 					{Path: "./some-path-2", Sha: "def-some-sha"},
 				})
@@ -60,29 +65,107 @@ var _ = Describe("Store", func() {
 		})
 
 		Context("when queried for step and some of matching objects", func() {
-			It("returns true for cached steps", func() {
-				cached, err := dbClient.IsCached("some-step", 1, []fs.Object{
+			It("returns false for cached steps", func() {
+				cached, err := dbClient.IsCached(parser.Step{Command: "some-step"}, []fs.Object{
 					{Path: "./some-path-1", Sha: "abc-some-sha"},
 				})
 				Expect(err).NotTo(HaveOccurred())
-				Expect(cached).To(BeTrue())
+				Expect(cached).To(BeFalse())
 			})
 		})
 
 		Context("when queried for mismatched step instructions", func() {
 			It("returns false for cached steps", func() {
-				cached, err := dbClient.IsCached("some-non-existent-step", 1, []fs.Object{
+				cached, err := dbClient.IsCached(parser.Step{Command: "some-non-existent-step"}, []fs.Object{
+					{Path: "./some-path-1", Sha: "abc-some-sha"},
+					{Path: "./some-path-2", Sha: "def-some-sha"},
+				})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(cached).To(BeFalse())
+			})
+		})
+
+		Context("when queried for mismatched step identity", func() {
+			It("returns false for cached steps", func() {
+				cached, err := dbClient.IsCached(parser.Step{Name: "some-name", Command: "some-step"}, []fs.Object{
+					{Path: "./some-path-1", Sha: "abc-some-sha"},
+					{Path: "./some-path-2", Sha: "def-some-sha"},
+				})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(cached).To(BeFalse())
+			})
+		})
+
+		Context("when another step observed different objects at the same path", func() {
+			BeforeEach(func() {
+				err := dbClient.Save(parser.Step{Command: "some-other-step"}, []fs.Object{
+					{Path: "./some-path-1", Sha: "ghi-some-sha"},
+				})
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("only considers the objects of the queried step", func() {
+				cached, err := dbClient.IsCached(parser.Step{Command: "some-step"}, []fs.Object{
+					{Path: "./some-path-1", Sha: "ghi-some-sha"},
+					{Path: "./some-path-2", Sha: "def-some-sha"},
+				})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(cached).To(BeFalse())
+
+				cached, err = dbClient.IsCached(parser.Step{Command: "some-step"}, []fs.Object{
 					{Path: "./some-path-1", Sha: "abc-some-sha"},
 					{Path: "./some-path-2", Sha: "def-some-sha"},
 				})
 				Expect(err).NotTo(HaveOccurred())
+				Expect(cached).To(BeTrue())
+			})
+		})
+
+		Context("when the step is saved again with different objects", func() {
+			BeforeEach(func() {
+				err := dbClient.Save(parser.Step{Command: "some-step"}, []fs.Object{
+					{Path: "./some-path-1", Sha: "ghi-some-sha"},
+				})
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("forgets the objects of the earlier run", func() {
+				cached, err := dbClient.IsCached(parser.Step{Command: "some-step"}, []fs.Object{
+					{Path: "./some-path-2", Sha: "def-some-sha"},
+				})
+				Expect(err).NotTo(HaveOccurred())
 				Expect(cached).To(BeFalse())
 			})
 		})
 
-		Context("when queried for mismatched step index", func() {
+		Context("when the attempts of the step are recorded", func() {
+			It("counts the runs that took more than one attempt", func() {
+				step := parser.Step{Command: "some-step"}
+
+				Expect(dbClient.RecordAttempts(step, 1)).To(Succeed())
+				flakyRuns, err := dbClient.FlakyRuns(step)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(flakyRuns).To(Equal(0))
+
+				Expect(dbClient.RecordAttempts(step, 3)).To(Succeed())
+				Expect(dbClient.RecordAttempts(step, 2)).To(Succeed())
+				flakyRuns, err = dbClient.FlakyRuns(step)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(flakyRuns).To(Equal(2))
+			})
+		})
+
+		Context("when the step is always cached", func() {
+			It("returns true for cached steps regardless of objects", func() {
+				cached, err := dbClient.IsCached(parser.Step{Command: "some-step", Cache: parser.CacheAlways}, nil)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(cached).To(BeTrue())
+			})
+		})
+
+		Context("when the step is never cached", func() {
 			It("returns false for cached steps", func() {
-				cached, err := dbClient.IsCached("some-step", -1, []fs.Object{
+				cached, err := dbClient.IsCached(parser.Step{Command: "some-step", Cache: parser.CacheNever}, []fs.Object{
 					{Path: "./some-path-1", Sha: "abc-some-sha"},
 					{Path: "./some-path-2", Sha: "def-some-sha"},
 				})
@@ -91,12 +174,162 @@ var _ = Describe("Store", func() {
 			})
 		})
 
+		Context("when the step has a cache ttl", func() {
+			var objects = []fs.Object{
+				{Path: "./some-path-1", Sha: "abc-some-sha"},
+				{Path: "./some-path-2", Sha: "def-some-sha"},
+			}
+
+			It("returns true for cached steps saved within the ttl", func() {
+				cached, err := dbClient.IsCached(parser.Step{Command: "some-step", CacheTTL: time.Hour}, objects)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(cached).To(BeTrue())
+			})
+
+			It("returns false for cached steps saved before the ttl", func() {
+				conn := sqlx.MustConnect("sqlite3", filepath.Join(dir, "snb.db"))
+				defer conn.Close()
+
+				_, err := conn.Exec("update steps set updated_at = datetime('now', '-2 hours')")
+				Expect(err).NotTo(HaveOccurred())
+
+				cached, err := dbClient.IsCached(parser.Step{Command: "some-step", CacheTTL: time.Hour}, objects)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(cached).To(BeFalse())
+
+				cached, err = dbClient.IsCached(parser.Step{Command: "some-step"}, objects)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(cached).To(BeTrue())
+			})
+		})
+
+		Context("when the exports of the step are saved", func() {
+			It("returns the exports of the latest run", func() {
+				step := parser.Step{Command: "some-step"}
+
+				exports, err := dbClient.Exports(step)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(exports).To(BeEmpty())
+
+				Expect(dbClient.SaveExports(step, []string{"SOME_KEY=some-value", "OTHER_KEY=a=b"})).To(Succeed())
+				exports, err = dbClient.Exports(step)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(exports).To(Equal([]string{"SOME_KEY=some-value", "OTHER_KEY=a=b"}))
+
+				Expect(dbClient.SaveExports(step, nil)).To(Succeed())
+				exports, err = dbClient.Exports(step)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(exports).To(BeEmpty())
+			})
+		})
+
+		Context("when an object observed by the cached step is gone", func() {
+			BeforeEach(func() {
+				err := dbClient.Save(parser.Step{Command: "some-step"}, []fs.Object{
+					{Path: "src/a.txt", Sha: "some-sha"},
+					{Path: "src/b.txt", Sha: "some-other-sha"},
+					{Path: "out.txt", Sha: "some-output-sha"},
+				})
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("returns false", func() {
+				cached, err := dbClient.IsCached(parser.Step{Command: "some-step"}, []fs.Object{
+					{Path: "src/a.txt", Sha: "some-sha"},
+					{Path: "out.txt", Sha: "some-output-sha"},
+				})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(cached).To(BeFalse())
+
+				cached, err = dbClient.IsCached(parser.Step{Command: "some-step"}, []fs.Object{
+					{Path: "src/a.txt", Sha: "some-sha"},
+					{Path: "src/b.txt", Sha: "some-other-sha"},
+					{Path: "out.txt", Sha: "some-output-sha"},
+				})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(cached).To(BeTrue())
+			})
+		})
+
+		Context("when asked whether a step has run", func() {
+			It("returns whether any run of the step was saved", func() {
+				ran, err := dbClient.HasRun(parser.Step{Command: "some-step", Inputs: []string{"other-input"}})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(ran).To(BeTrue())
+
+				ran, err = dbClient.HasRun(parser.Step{Command: "some-new-step"})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(ran).To(BeFalse())
+			})
+		})
+
 		Context("when queried for step with no objects", func() {
 			It("returns false for cached steps", func() {
-				cached, err := dbClient.IsCached("some-step", 1, []fs.Object{})
+				cached, err := dbClient.IsCached(parser.Step{Command: "some-step"}, []fs.Object{})
 				Expect(err).NotTo(HaveOccurred())
 				Expect(cached).To(BeFalse())
 			})
 		})
 	})
+	Describe("when a database indexed by step number exists", func() {
+		BeforeEach(func() {
+			Expect(dbClient.Close()).To(Succeed())
+			Expect(os.Remove(filepath.Join(dir, "snb.db"))).To(Succeed())
+
+			legacyDB, err := sql.Open("sqlite3", filepath.Join(dir, "snb.db"))
+			Expect(err).NotTo(HaveOccurred())
+			defer legacyDB.Close()
+
+			_, err = legacyDB.Exec(`
+			create table objects (
+			  id integer not null primary key,
+			  path text not null unique,
+			  sha text not null,
+			  updated_at timestamp default current_timestamp not null
+			);
+
+			create table steps (
+			  id integer not null primary key,
+			  definition text not null,
+			  number integer not null unique,
+			  updated_at timestamp default current_timestamp not null
+			);
+
+			insert into objects (path, sha) values ('./some-path-1', 'abc-some-sha');
+			insert into steps (definition, number) values ('some-step', 0);
+			`)
+			Expect(err).NotTo(HaveOccurred())
+
+			dbClient, err = New(dir)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("migrates the steps regardless of their position", func() {
+			By("running the steps once more, as their objects cannot be attributed")
+			cached, err := dbClient.IsCached(parser.Step{Command: "some-step"}, []fs.Object{
+				{Path: "./some-path-1", Sha: "abc-some-sha"},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cached).To(BeFalse())
+
+			err = dbClient.Save(parser.Step{Command: "some-step"}, []fs.Object{
+				{Path: "./some-path-1", Sha: "abc-some-sha"},
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			cached, err = dbClient.IsCached(parser.Step{Command: "some-step"}, []fs.Object{
+				{Path: "./some-path-1", Sha: "abc-some-sha"},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cached).To(BeTrue())
+
+			conn := sqlx.MustConnect("sqlite3", filepath.Join(dir, "snb.db"))
+			defer conn.Close()
+
+			var count int
+			err = conn.Get(&count, "select count(*) from steps")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(count).To(Equal(1))
+		})
+	})
 })
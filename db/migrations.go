@@ -0,0 +1,153 @@
+package db
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aemengo/snb/parser"
+	"github.com/jmoiron/sqlx"
+)
+
+// migrations bring a database up to date with the current schema. The
+// schema version of a database is tracked by its user_version pragma,
+// where version N means that the first N migrations have been applied.
+var migrations = []func(tx *sqlx.Tx) error{
+	createTables,
+	identifyStepsByID,
+	recordObjectsPerStep,
+	recordAttempts,
+	recordExports,
+}
+
+func migrate(db *sqlx.DB) error {
+	var version int
+	if err := db.Get(&version, "pragma user_version"); err != nil {
+		return err
+	}
+
+	for ; version < len(migrations); version++ {
+		tx, err := db.Beginx()
+		if err != nil {
+			return err
+		}
+
+		if err := migrations[version](tx); err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		// pragmas do not support bound parameters
+		if _, err := tx.Exec(fmt.Sprintf("pragma user_version = %d", version+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// createTables creates the original schema, where steps were identified
+// by their index in the spec. Databases created before schema versions
+// were tracked already contain these tables.
+func createTables(tx *sqlx.Tx) error {
+	_, err := tx.Exec(`
+	create table if not exists objects (
+	  id integer not null primary key,
+	  path text not null unique,
+	  sha text not null,
+	  updated_at timestamp default current_timestamp not null
+	);
+
+	create table if not exists steps (
+	  id integer not null primary key,
+	  definition text not null,
+	  number integer not null unique,
+	  updated_at timestamp default current_timestamp not null
+	);
+	`)
+	return err
+}
+
+// identifyStepsByID keys steps by their identity instead of their index,
+// so that inserting a step does not invalidate the ones that follow it
+func identifyStepsByID(tx *sqlx.Tx) error {
+	var steps []struct {
+		Definition string    `db:"definition"`
+		UpdatedAt  time.Time `db:"updated_at"`
+	}
+
+	err := tx.Select(&steps, "select definition, updated_at from steps order by number")
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+	drop table steps;
+
+	create table steps (
+	  id integer not null primary key,
+	  identity text not null unique,
+	  definition text not null,
+	  updated_at timestamp default current_timestamp not null
+	);
+	`)
+	if err != nil {
+		return err
+	}
+
+	// steps used to be recorded with nothing but their command, and
+	// any later duplicate of a command simply runs again
+	for _, step := range steps {
+		_, err = tx.Exec(`
+		insert or ignore into steps
+		  (identity, definition, updated_at) VALUES
+		  ($1, $2, $3)`,
+			parser.Step{Command: step.Definition}.ID(), step.Definition, step.UpdatedAt,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// recordObjectsPerStep replaces the objects table, which was shared by
+// every step, with the checksums each individual step observed. As the
+// objects cannot be attributed to the steps that referenced them, those
+// steps run once more before being cached again.
+func recordObjectsPerStep(tx *sqlx.Tx) error {
+	_, err := tx.Exec(`
+	drop table objects;
+
+	create table step_inputs (
+	  id integer not null primary key,
+	  step_id integer not null references steps(id) on delete cascade,
+	  path text not null,
+	  sha text not null,
+	  unique (step_id, path)
+	);
+	`)
+	return err
+}
+
+// recordAttempts tracks how many attempts the last run of each step took,
+// and how many of its runs needed more than one
+func recordAttempts(tx *sqlx.Tx) error {
+	_, err := tx.Exec(`
+	alter table steps add column attempts integer default 1 not null;
+	alter table steps add column flaky_runs integer default 0 not null;
+	`)
+	return err
+}
+
+// recordExports stores the variables each step exported in its last run,
+// one KEY=value line after another
+func recordExports(tx *sqlx.Tx) error {
+	_, err := tx.Exec(`alter table steps add column exports text default '' not null`)
+	return err
+}
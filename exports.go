@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/aemengo/snb/parser"
+)
+
+// exportVariable names the file that a step writes the variables it
+// exports to, as KEY=value lines
+const exportVariable = "SNB_EXPORT"
+
+var exportPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*=`)
+
+// readExports returns the variables written to an export file, where a
+// variable exported more than once takes its last value
+func readExports(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var exports []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		if !exportPattern.MatchString(line) {
+			return nil, fmt.Errorf("invalid export %q, expected KEY=value", line)
+		}
+
+		exports = setVariable(exports, line)
+	}
+
+	return exports, scanner.Err()
+}
+
+// setVariable adds a KEY=value variable to a list of them, replacing any
+// earlier value of the same key
+func setVariable(variables []string, variable string) []string {
+	key := variable[:strings.Index(variable, "=")+1]
+	for index, existing := range variables {
+		if strings.HasPrefix(existing, key) {
+			variables = append(variables[:index], variables[index+1:]...)
+			break
+		}
+	}
+
+	return append(variables, variable)
+}
+
+// exportsFor returns the variables exported by the given steps, in order.
+// Steps that have not run during this build export the variables of
+// their last run.
+func (r *runner) exportsFor(indexes []int) ([]string, error) {
+	var exports []string
+
+	for _, index := range indexes {
+		r.mutex.Lock()
+		exported, ok := r.exports[index]
+		r.mutex.Unlock()
+
+		if !ok {
+			var err error
+			exported, err = r.dbClient.Exports(r.spec.Steps[index])
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		for _, variable := range exported {
+			exports = setVariable(exports, variable)
+		}
+	}
+
+	return exports, nil
+}
+
+// restoreExports makes the variables exported by the last run of a
+// cached step available to the steps that follow it
+func (r *runner) restoreExports(index int, step parser.Step) error {
+	exported, err := r.dbClient.Exports(step)
+	if err != nil {
+		return err
+	}
+
+	r.mutex.Lock()
+	r.exports[index] = exported
+	r.mutex.Unlock()
+	return nil
+}
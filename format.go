@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bytes"
+	"os"
+
+	"github.com/aemengo/snb/fs"
+	"github.com/aemengo/snb/parser"
+)
+
+// formatSpec rewrites the ShakeAndBakeFile in its canonical layout or,
+// when check is set, exits with a failure if it is not already in it
+func formatSpec(fsClient *fs.FS, check bool) {
+	specFile := "ShakeAndBakeFile"
+	if !fsClient.Exists(specFile) {
+		fatal("ShakeAndBakeFile not found. please execute in directory containing spec, or pass the working directory in as the only argument")
+	}
+
+	contents, err := fsClient.Get(specFile)
+	if err != nil {
+		fatal(err)
+	}
+
+	ast, err := parser.ParseAST(specFile, contents)
+	if err != nil {
+		fatal(err)
+	}
+
+	formatted := parser.Format(ast)
+	if bytes.Equal(contents, formatted) {
+		return
+	}
+
+	if check {
+		boldRed.Println("ShakeAndBakeFile is not formatted, run snb fmt to format it")
+		os.Exit(1)
+	}
+
+	if err := fsClient.Put(specFile, formatted); err != nil {
+		fatal(err)
+	}
+}
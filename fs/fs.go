@@ -8,6 +8,8 @@ import (
 	"path/filepath"
 	"strings"
 	"io/ioutil"
+
+	"github.com/aemengo/snb/parser"
 )
 
 type Object struct {
@@ -34,6 +36,16 @@ func (fs *FS) Get(path string) ([]byte, error) {
 	return ioutil.ReadFile(fs.p(path))
 }
 
+// Put replaces the contents of an existing file, keeping its permissions
+func (fs *FS) Put(path string, contents []byte) error {
+	info, err := os.Stat(fs.p(path))
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(fs.p(path), contents, info.Mode())
+}
+
 func (fs *FS) Exists(path string) bool {
 	_, err := os.Stat(fs.p(path))
 	if os.IsNotExist(err) {
@@ -43,11 +55,38 @@ func (fs *FS) Exists(path string) bool {
 	return true
 }
 
-//TODO support globbing
-func  (fs *FS) GetSrcFiles(step string) ([]Object, error) {
+// Glob returns the paths matching the pattern, relative to the working
+// directory unless the pattern is absolute
+func (fs *FS) Glob(pattern string) ([]string, error) {
+	matches, err := filepath.Glob(fs.p(pattern))
+	if err != nil || filepath.IsAbs(pattern) {
+		return matches, err
+	}
+
+	for index, match := range matches {
+		matches[index], err = filepath.Rel(fs.workingDir, match)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return matches, nil
+}
+
+// GetSrcFiles returns the files and directories a step reads from,
+// relative to the directory it executes in. When the step declares its
+// inputs those are used, otherwise any word of the command that names an
+// existing path is considered an input.
+func  (fs *FS) GetSrcFiles(step parser.Step) ([]Object, error) {
+	fs = fs.dir(step)
+
+	if len(step.Inputs) > 0 {
+		return fs.globObjects(step.Inputs)
+	}
+
 	var objects []Object
 
-	for _, item := range strings.Split(step, " ") {
+	for _, item := range strings.Fields(step.Command) {
 		element := strings.TrimSpace(item)
 
 		if element == "" {
@@ -78,6 +117,56 @@ func  (fs *FS) GetSrcFiles(step string) ([]Object, error) {
 	return objects, nil
 }
 
+// GetOutputFiles returns the files and directories a step declares
+// that it writes to. Any declared output that does not exist is returned
+// with an empty sha.
+func (fs *FS) GetOutputFiles(step parser.Step) ([]Object, error) {
+	return fs.dir(step).globObjects(step.Outputs)
+}
+
+// dir returns an FS rooted at the directory a step executes in, which
+// its paths are relative to
+func (fs *FS) dir(step parser.Step) *FS {
+	return &FS{
+		workingDir: fs.p(step.WorkDir),
+	}
+}
+
+func (fs *FS) globObjects(patterns []string) ([]Object, error) {
+	var objects []Object
+
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(fs.p(pattern))
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %s", pattern, err)
+		}
+
+		if len(matches) == 0 {
+			objects = append(objects, Object{Path: pattern})
+			continue
+		}
+
+		for _, match := range matches {
+			path := match
+			if !filepath.IsAbs(pattern) {
+				path, err = filepath.Rel(fs.workingDir, match)
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			obj, err := fs.objectFrom(path)
+			if err != nil {
+				return nil, err
+			}
+
+			objects = append(objects, obj)
+		}
+	}
+
+	return objects, nil
+}
+
 func (fs *FS) objectFrom(path string) (Object, error) {
 	srcPath := fs.p(path)
 
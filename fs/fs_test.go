@@ -8,6 +8,7 @@ import (
 	"io/ioutil"
 	"path/filepath"
 	"os"
+	"github.com/aemengo/snb/parser"
 )
 
 var _ = Describe("Fs", func() {
@@ -63,6 +64,39 @@ var _ = Describe("Fs", func() {
 		})
 	})
 
+	Describe("Put", func() {
+		Context("when the file exists", func() {
+			BeforeEach(func() {
+				err := ioutil.WriteFile(
+					filepath.Join(workingDir, "sample-file"),
+					[]byte("some-sample-file-content"),
+					0700,
+				)
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("replaces its contents and keeps its permissions", func() {
+				err := fsClient.Put("sample-file", []byte("other-content"))
+				Expect(err).NotTo(HaveOccurred())
+
+				contents, err := ioutil.ReadFile(filepath.Join(workingDir, "sample-file"))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(contents)).To(Equal("other-content"))
+
+				info, err := os.Stat(filepath.Join(workingDir, "sample-file"))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(info.Mode().Perm()).To(Equal(os.FileMode(0700)))
+			})
+		})
+
+		Context("when the file does not exist", func() {
+			It("returns the error", func() {
+				err := fsClient.Put("sample-non-existent-file", []byte("other-content"))
+				Expect(err).To(HaveOccurred())
+			})
+		})
+	})
+
 	Describe("Exists", func() {
 		BeforeEach(func() {
 			err := ioutil.WriteFile(
@@ -95,6 +129,32 @@ var _ = Describe("Fs", func() {
 		})
 	})
 
+	Describe("Glob", func() {
+		BeforeEach(func() {
+			err := os.MkdirAll(filepath.Join(workingDir, "services", "api"), os.ModePerm)
+			Expect(err).NotTo(HaveOccurred())
+
+			err = os.MkdirAll(filepath.Join(workingDir, "services", "web"), os.ModePerm)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		Context("when a relative pattern is provided", func() {
+			It("returns the matching paths relative to the working directory", func() {
+				matches, err := fsClient.Glob("services/*")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(matches).To(Equal([]string{"services/api", "services/web"}))
+			})
+		})
+
+		Context("when an absolute pattern is provided", func() {
+			It("returns the matching absolute paths", func() {
+				matches, err := fsClient.Glob(filepath.Join(workingDir, "services", "a*"))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(matches).To(Equal([]string{filepath.Join(workingDir, "services", "api")}))
+			})
+		})
+	})
+
 	Describe("GetSrcFiles", func() {
 		BeforeEach(func() {
 			err := ioutil.WriteFile(
@@ -114,7 +174,7 @@ var _ = Describe("Fs", func() {
 
 		Context("when a step with matching filenames is provided", func() {
 			It("returns objects with the sha representations", func() {
-				objs, err := fsClient.GetSrcFiles("./sample-file-1 && ./sample-file-2")
+				objs, err := fsClient.GetSrcFiles(parser.Step{Command: "./sample-file-1 && ./sample-file-2"})
 				Expect(err).NotTo(HaveOccurred())
 				Expect(len(objs)).To(Equal(2))
 				Expect(objs[0].Path).To(Equal("./sample-file-1"))
@@ -127,7 +187,7 @@ var _ = Describe("Fs", func() {
 
 		Context("when a step with matching filenames and plenty of whitespace is provided", func() {
 			It("returns objects with the sha representations", func() {
-				objs, err := fsClient.GetSrcFiles("./sample-file-1 && \n \n     ./sample-file-2")
+				objs, err := fsClient.GetSrcFiles(parser.Step{Command: "./sample-file-1 && \n \n     ./sample-file-2"})
 				Expect(err).NotTo(HaveOccurred())
 				Expect(len(objs)).To(Equal(2))
 				Expect(objs[0].Path).To(Equal("./sample-file-1"))
@@ -140,7 +200,7 @@ var _ = Describe("Fs", func() {
 
 		Context("when a step with matching and nonmatching filenames is provided", func() {
 			It("returns matching objects with the sha representations", func() {
-				objs, err := fsClient.GetSrcFiles("./sample-file-1 && ./some-non-existent-file")
+				objs, err := fsClient.GetSrcFiles(parser.Step{Command: "./sample-file-1 && ./some-non-existent-file"})
 				Expect(err).NotTo(HaveOccurred())
 
 				Expect(len(objs)).To(Equal(1))
@@ -151,7 +211,7 @@ var _ = Describe("Fs", func() {
 
 		Context("when a step with an absolute path", func() {
 			It("returns matching objects with the sha representations", func() {
-				objs, err := fsClient.GetSrcFiles(filepath.Join(workingDir, "sample-file-1"))
+				objs, err := fsClient.GetSrcFiles(parser.Step{Command: filepath.Join(workingDir, "sample-file-1")})
 				Expect(err).NotTo(HaveOccurred())
 
 				Expect(len(objs)).To(Equal(1))
@@ -174,7 +234,7 @@ var _ = Describe("Fs", func() {
 			})
 
 			It("returns matching objects with the sha representations", func() {
-				objs, err := fsClient.GetSrcFiles("cp some-directory")
+				objs, err := fsClient.GetSrcFiles(parser.Step{Command: "cp some-directory"})
 				Expect(err).NotTo(HaveOccurred())
 
 				Expect(len(objs)).To(Equal(1))
@@ -197,7 +257,7 @@ var _ = Describe("Fs", func() {
 			})
 
 			It("returns matching golang dir with the sha representations", func() {
-				objs, err := fsClient.GetSrcFiles("go build golang-repo")
+				objs, err := fsClient.GetSrcFiles(parser.Step{Command: "go build golang-repo"})
 				Expect(err).NotTo(HaveOccurred())
 
 				Expect(len(objs)).To(Equal(1))
@@ -205,5 +265,73 @@ var _ = Describe("Fs", func() {
 				Expect(objs[0].Sha).NotTo(BeEmpty())
 			})
 		})
+		Context("when a step executes in a working directory", func() {
+			BeforeEach(func() {
+				err := os.MkdirAll(filepath.Join(workingDir, "some-directory"), os.ModePerm)
+				Expect(err).NotTo(HaveOccurred())
+
+				err = ioutil.WriteFile(
+					filepath.Join(workingDir, "some-directory", "sample-file-3"),
+					[]byte("some-sample-file-content-3"),
+					0600,
+				)
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("resolves paths relative to the working directory", func() {
+				objs, err := fsClient.GetSrcFiles(parser.Step{
+					Command: "./sample-file-1 && ./sample-file-3",
+					WorkDir: "some-directory",
+				})
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(len(objs)).To(Equal(1))
+				Expect(objs[0].Path).To(Equal("./sample-file-3"))
+				Expect(objs[0].Sha).NotTo(BeEmpty())
+			})
+		})
+
+		Context("when a step declares its inputs", func() {
+			It("returns objects for the declared inputs only", func() {
+				objs, err := fsClient.GetSrcFiles(parser.Step{
+					Command: "./sample-file-1 && ./some-script",
+					Inputs:  []string{"sample-file-*"},
+				})
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(len(objs)).To(Equal(2))
+				Expect(objs[0].Path).To(Equal("sample-file-1"))
+				Expect(objs[0].Sha).NotTo(BeEmpty())
+				Expect(objs[1].Path).To(Equal("sample-file-2"))
+				Expect(objs[1].Sha).NotTo(BeEmpty())
+			})
+		})
+	})
+
+	Describe("GetOutputFiles", func() {
+		BeforeEach(func() {
+			err := ioutil.WriteFile(
+				filepath.Join(workingDir, "sample-output"),
+				[]byte("some-sample-output-content"),
+				0600,
+			)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("returns objects for the declared outputs", func() {
+			objs, err := fsClient.GetOutputFiles(parser.Step{
+				Command: "./some-script",
+				Outputs: []string{"sample-output", "some-missing-output"},
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(len(objs)).To(Equal(2))
+			Expect(objs[0].Path).To(Equal("sample-output"))
+			Expect(objs[0].Sha).NotTo(BeEmpty())
+
+			By("leaving the sha of missing outputs empty")
+			Expect(objs[1].Path).To(Equal("some-missing-output"))
+			Expect(objs[1].Sha).To(BeEmpty())
+		})
 	})
 })
@@ -0,0 +1,6 @@
+#!/usr/bin/env bash
+
+mkdir -p build
+cat input.txt > build/result
+
+echo "executing build"
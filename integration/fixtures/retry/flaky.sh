@@ -0,0 +1,8 @@
+#!/usr/bin/env bash
+
+count=$(cat attempts 2>/dev/null || echo 0)
+count=$((count + 1))
+echo "$count" > attempts
+
+echo "flaky attempt $count"
+[ "$count" -ge 2 ]
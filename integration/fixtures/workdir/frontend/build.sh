@@ -0,0 +1,3 @@
+#!/usr/bin/env bash
+
+echo "building in $(basename "$PWD")"
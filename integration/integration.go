@@ -4,10 +4,13 @@ import (
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"os/exec"
+	"encoding/json"
 	"github.com/onsi/gomega/gexec"
 	"github.com/onsi/gomega/gbytes"
 	"os"
 	"path/filepath"
+	"io/ioutil"
+	"time"
 )
 
 var _ = Describe("Integration", func() {
@@ -97,6 +100,749 @@ var _ = Describe("Integration", func() {
 		})
 	})
 
+	Describe("declared inputs and outputs", func() {
+		BeforeEach(func() {
+			workingDir = fixturePath("declared-io")
+		})
+
+		It("re-runs the step when a declared output is removed", func() {
+			defer os.RemoveAll(filepath.Join(fixturePath("declared-io"), "build"))
+
+			command := exec.Command(binaryPath, workingDir)
+			session, err := gexec.Start(command, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(session).To(gbytes.Say(`---> Running`))
+
+			command = exec.Command(binaryPath, workingDir)
+			session, err = gexec.Start(command, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(session).To(gbytes.Say(`---> Using cache`))
+
+			err = os.RemoveAll(filepath.Join(fixturePath("declared-io"), "build"))
+			Expect(err).NotTo(HaveOccurred())
+
+			command = exec.Command(binaryPath, workingDir)
+			session, err = gexec.Start(command, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(session).To(gbytes.Say(`---> Running`))
+			Expect(session).To(gbytes.Say(`executing build`))
+		})
+	})
+
+	Describe("running a named step", func() {
+		BeforeEach(func() {
+			workingDir = fixturePath("named-steps")
+		})
+
+		It("executes only the named step", func() {
+			command := exec.Command(binaryPath, "run", "second", workingDir)
+			session, err := gexec.Start(command, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+
+			Expect(session).To(gbytes.Say(`Step 1/1 : second`))
+			Expect(session).To(gbytes.Say(`executing second`))
+			Expect(session.Out.Contents()).NotTo(SatisfyAny(
+				ContainSubstring("executing first"),
+				ContainSubstring("executing third"),
+			))
+		})
+
+		It("executes the named step along with its dependencies", func() {
+			command := exec.Command(binaryPath, "run", "--deps", "second", workingDir)
+			session, err := gexec.Start(command, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+
+			Expect(session).To(gbytes.Say(`Step 1/2 : first`))
+			Expect(session).To(gbytes.Say(`executing first`))
+			Expect(session).To(gbytes.Say(`Step 2/2 : second`))
+			Expect(session).To(gbytes.Say(`executing second`))
+			Expect(session.Out.Contents()).NotTo(ContainSubstring("executing third"))
+		})
+
+		It("returns an error for an unknown step", func() {
+			command := exec.Command(binaryPath, "run", "fourth", workingDir)
+			session, err := gexec.Start(command, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+
+			<-session.Exited
+			Expect(session.ExitCode()).NotTo(Equal(0))
+			Expect(session).To(gbytes.Say(`no step named "fourth"`))
+		})
+	})
+
+	Describe("changing an upstream step", func() {
+		var inputPath string
+
+		BeforeEach(func() {
+			workingDir = fixturePath("chained")
+			inputPath = filepath.Join(workingDir, "input.txt")
+
+			err := ioutil.WriteFile(inputPath, []byte("some content"), 0600)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(inputPath)
+		})
+
+		It("invalidates the steps that follow it", func() {
+			command := exec.Command(binaryPath, workingDir)
+			session, err := gexec.Start(command, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+
+			err = ioutil.WriteFile(inputPath, []byte("some changed content"), 0600)
+			Expect(err).NotTo(HaveOccurred())
+
+			command = exec.Command(binaryPath, workingDir)
+			session, err = gexec.Start(command, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+
+			Expect(session).To(gbytes.Say(`Step 1/2`))
+			Expect(session).To(gbytes.Say(`executing step 1`))
+			Expect(session).To(gbytes.Say(`Step 2/2`))
+			Expect(session).To(gbytes.Say(`---> Invalidated by step 1`))
+			Expect(session).To(gbytes.Say(`executing step 2`))
+
+			By("opting out of invalidation")
+
+			err = ioutil.WriteFile(inputPath, []byte("some other content"), 0600)
+			Expect(err).NotTo(HaveOccurred())
+
+			command = exec.Command(binaryPath, "--no-chain", workingDir)
+			session, err = gexec.Start(command, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+
+			Expect(session).To(gbytes.Say(`executing step 1`))
+			Expect(session).To(gbytes.Say(`Step 2/2`))
+			Expect(session).To(gbytes.Say(`---> Using cache`))
+		})
+	})
+
+	Describe("chained steps after an inserted step", func() {
+		var (
+			specPath     string
+			specContents []byte
+		)
+
+		BeforeEach(func() {
+			workingDir = fixturePath("inserted-step")
+			specPath = filepath.Join(workingDir, "ShakeAndBakeFile")
+
+			var err error
+			specContents, err = ioutil.ReadFile(specPath)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			ioutil.WriteFile(specPath, specContents, 0644)
+		})
+
+		It("does not invalidate the steps that follow it", func() {
+			command := exec.Command(binaryPath, workingDir)
+			session, err := gexec.Start(command, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+
+			err = ioutil.WriteFile(specPath, append([]byte("RUN cat c.txt\n\n"), specContents...), 0644)
+			Expect(err).NotTo(HaveOccurred())
+
+			command = exec.Command(binaryPath, workingDir)
+			session, err = gexec.Start(command, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+
+			Expect(session).To(gbytes.Say(`Step 1/3`))
+			Expect(session).To(gbytes.Say(`contents of c`))
+			Expect(session).To(gbytes.Say(`Step 2/3`))
+			Expect(session).To(gbytes.Say(`---> Using cache`))
+			Expect(session).To(gbytes.Say(`Step 3/3`))
+			Expect(session).To(gbytes.Say(`---> Using cache`))
+			Expect(session.Out.Contents()).NotTo(ContainSubstring("Invalidated"))
+		})
+	})
+
+	Describe("chained steps after an uncacheable step", func() {
+		BeforeEach(func() {
+			workingDir = fixturePath("uncacheable-upstream")
+		})
+
+		It("does not invalidate the steps that follow it", func() {
+			command := exec.Command(binaryPath, workingDir)
+			session, err := gexec.Start(command, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+
+			command = exec.Command(binaryPath, workingDir)
+			session, err = gexec.Start(command, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+
+			Expect(session).To(gbytes.Say(`Step 1/2`))
+			Expect(session).To(gbytes.Say(`executing step 1`))
+			Expect(session).To(gbytes.Say(`Step 2/2`))
+			Expect(session).To(gbytes.Say(`---> Using cache`))
+			Expect(session.Out.Contents()).NotTo(ContainSubstring("Invalidated"))
+		})
+	})
+
+	Describe("parallel execution", func() {
+		BeforeEach(func() {
+			workingDir = fixturePath("parallel")
+		})
+
+		It("executes independent steps concurrently", func() {
+			startTime := time.Now()
+
+			command := exec.Command(binaryPath, "-j", "2", workingDir)
+			session, err := gexec.Start(command, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+
+			Expect(time.Since(startTime)).To(BeNumerically("<", 4*time.Second))
+			Expect(session.Out.Contents()).To(SatisfyAll(
+				ContainSubstring("executing lint"),
+				ContainSubstring("executing test"),
+			))
+			Expect(session).To(gbytes.Say(`Step 4/4 : package`))
+			Expect(session).To(gbytes.Say(`executing package`))
+			Expect(session).To(gbytes.Say(`Build completed`))
+		})
+	})
+
+	Describe("build arguments", func() {
+		BeforeEach(func() {
+			workingDir = fixturePath("build-args")
+		})
+
+		It("executes steps again when an argument changes", func() {
+			command := exec.Command(binaryPath, workingDir)
+			session, err := gexec.Start(command, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(session).To(gbytes.Say(`building 1.0 with hello world`))
+
+			command = exec.Command(binaryPath, workingDir)
+			session, err = gexec.Start(command, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(session).To(gbytes.Say(`---> Using cache`))
+
+			command = exec.Command(binaryPath, "--build-arg", "VERSION=2.0", workingDir)
+			session, err = gexec.Start(command, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(session).To(gbytes.Say(`---> Running`))
+			Expect(session).To(gbytes.Say(`building 2.0 with hello world`))
+		})
+	})
+
+	Describe("working directories", func() {
+		BeforeEach(func() {
+			workingDir = fixturePath("workdir")
+		})
+
+		It("executes and caches steps relative to the working directory", func() {
+			command := exec.Command(binaryPath, workingDir)
+			session, err := gexec.Start(command, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(session).To(gbytes.Say(`building in frontend`))
+
+			command = exec.Command(binaryPath, workingDir)
+			session, err = gexec.Start(command, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(session).To(gbytes.Say(`---> Using cache`))
+		})
+	})
+
+	Describe("included spec files", func() {
+		BeforeEach(func() {
+			workingDir = fixturePath("include")
+		})
+
+		It("executes the included steps", func() {
+			command := exec.Command(binaryPath, workingDir)
+			session, err := gexec.Start(command, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+
+			Expect(session).To(gbytes.Say(`Step 1/2`))
+			Expect(session).To(gbytes.Say(`executing shared`))
+			Expect(session).To(gbytes.Say(`Step 2/2`))
+			Expect(session).To(gbytes.Say(`executing main`))
+		})
+	})
+
+	Describe("heredoc steps", func() {
+		BeforeEach(func() {
+			workingDir = fixturePath("heredoc")
+		})
+
+		It("executes the body as a script", func() {
+			command := exec.Command(binaryPath, workingDir)
+			session, err := gexec.Start(command, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(session).To(gbytes.Say(`hello from heredoc`))
+		})
+	})
+
+	Describe("shells", func() {
+		BeforeEach(func() {
+			workingDir = fixturePath("shell")
+		})
+
+		It("executes each step with the shell declared before it", func() {
+			command := exec.Command(binaryPath, workingDir)
+			session, err := gexec.Start(command, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+
+			Expect(session).To(gbytes.Say(`Step 1/2 : echo "running under \$0" \(sh -eu -c\)`))
+			Expect(session).To(gbytes.Say(`running under sh`))
+			Expect(session).To(gbytes.Say(`Step 2/2 : echo "running under \$0" \(bash -c\)`))
+			Expect(session).To(gbytes.Say(`running under bash`))
+		})
+	})
+
+	Describe("interpolated variables", func() {
+		BeforeEach(func() {
+			workingDir = fixturePath("interpolation")
+		})
+
+		It("checksums the paths the variables expand to", func() {
+			command := exec.Command(binaryPath, workingDir)
+			session, err := gexec.Start(command, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(session).To(gbytes.Say(`Step 1/1 : ./scripts/build.sh gcc`))
+			Expect(session).To(gbytes.Say(`building with gcc`))
+
+			command = exec.Command(binaryPath, workingDir)
+			session, err = gexec.Start(command, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(session).To(gbytes.Say(`---> Using cache`))
+		})
+	})
+
+	Describe("expanded steps", func() {
+		BeforeEach(func() {
+			workingDir = fixturePath("foreach")
+		})
+
+		It("executes and caches a step for every item", func() {
+			command := exec.Command(binaryPath, workingDir)
+			session, err := gexec.Start(command, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(session).To(gbytes.Say(`Step 1/2 : build-services/api`))
+			Expect(session).To(gbytes.Say(`api`))
+			Expect(session).To(gbytes.Say(`Step 2/2 : build-services/web`))
+			Expect(session).To(gbytes.Say(`web`))
+
+			command = exec.Command(binaryPath, "run", "build-services/web", workingDir)
+			session, err = gexec.Start(command, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(session).To(gbytes.Say(`Step 1/1 : build-services/web`))
+			Expect(session).To(gbytes.Say(`---> Using cache`))
+		})
+	})
+
+	Describe("timeouts", func() {
+		BeforeEach(func() {
+			workingDir = fixturePath("timeout")
+		})
+
+		It("terminates a step that exceeds its timeout", func() {
+			command := exec.Command(binaryPath, "run", "hang", workingDir)
+			session, err := gexec.Start(command, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session, 5*time.Second).Should(gexec.Exit(124))
+			Expect(session).To(gbytes.Say(`waiting`))
+			Expect(session).To(gbytes.Say(`Build failed \(timed out after 1s\)`))
+		})
+
+		It("terminates a step that exceeds the global timeout", func() {
+			command := exec.Command(binaryPath, "run", "--timeout", "1s", "hang-forever", workingDir)
+			session, err := gexec.Start(command, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session, 5*time.Second).Should(gexec.Exit(124))
+			Expect(session).To(gbytes.Say(`Build failed \(timed out after 1s\)`))
+		})
+	})
+
+	Describe("retried steps", func() {
+		BeforeEach(func() {
+			workingDir = fixturePath("retry")
+		})
+
+		It("executes a failing step again", func() {
+			defer os.Remove(filepath.Join(fixturePath("retry"), "attempts"))
+
+			command := exec.Command(binaryPath, workingDir)
+			session, err := gexec.Start(command, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(session).To(gbytes.Say(`---> Running \(attempt 1/3\)`))
+			Expect(session).To(gbytes.Say(`flaky attempt 1`))
+			Expect(session).To(gbytes.Say(`---> Attempt 1/3 failed \(exit status 1\)`))
+			Expect(session).To(gbytes.Say(`---> Running \(attempt 2/3\)`))
+			Expect(session).To(gbytes.Say(`flaky attempt 2`))
+			Expect(session).To(gbytes.Say(`---> Succeeded on attempt 2/3 \(runs needing retries: 1\)`))
+		})
+	})
+
+	Describe("cache policies", func() {
+		BeforeEach(func() {
+			workingDir = fixturePath("cache")
+		})
+
+		It("caches steps according to their policy", func() {
+			command := exec.Command(binaryPath, workingDir)
+			session, err := gexec.Start(command, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(session).To(gbytes.Say(`deploying`))
+			Expect(session).To(gbytes.Say(`some input`))
+
+			command = exec.Command(binaryPath, "--no-chain", workingDir)
+			session, err = gexec.Start(command, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(session).To(gbytes.Say(`Step 1/2`))
+			Expect(session).To(gbytes.Say(`---> Using cache`))
+			Expect(session).To(gbytes.Say(`Step 2/2`))
+			Expect(session).To(gbytes.Say(`---> Running`))
+			Expect(session).To(gbytes.Say(`some input`))
+		})
+	})
+
+	Describe("yaml specs", func() {
+		BeforeEach(func() {
+			workingDir = fixturePath("yaml")
+		})
+
+		It("executes the steps of a snb.yaml", func() {
+			command := exec.Command(binaryPath, workingDir)
+			session, err := gexec.Start(command, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+
+			Expect(session).To(gbytes.Say(`Step 1/2 : generate`))
+			Expect(session).To(gbytes.Say(`generating for linux`))
+			Expect(session).To(gbytes.Say(`Step 2/2 : package`))
+			Expect(session).To(gbytes.Say(`packaging`))
+			Expect(session).To(gbytes.Say(`packaged`))
+		})
+	})
+
+	Describe("templates", func() {
+		BeforeEach(func() {
+			workingDir = fixturePath("template")
+		})
+
+		It("executes a step for every call", func() {
+			command := exec.Command(binaryPath, workingDir)
+			session, err := gexec.Start(command, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+
+			Expect(session).To(gbytes.Say(`Step 1/2 : greet-world`))
+			Expect(session).To(gbytes.Say(`hello, world`))
+			Expect(session).To(gbytes.Say(`Step 2/2 : greet-snb`))
+			Expect(session).To(gbytes.Say(`hi, there, snb`))
+		})
+	})
+
+	Describe("exported variables", func() {
+		BeforeEach(func() {
+			workingDir = fixturePath("export")
+		})
+
+		It("passes the variables on to later steps, even when cached", func() {
+			command := exec.Command(binaryPath, workingDir)
+			session, err := gexec.Start(command, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(session).To(gbytes.Say(`releasing 1.2.3`))
+
+			command = exec.Command(binaryPath, workingDir)
+			session, err = gexec.Start(command, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(session).To(gbytes.Say(`Step 1/2 : version`))
+			Expect(session).To(gbytes.Say(`---> Using cache`))
+			Expect(session).To(gbytes.Say(`releasing 1.2.3`))
+
+			command = exec.Command(binaryPath, "run", "release", workingDir)
+			session, err = gexec.Start(command, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(session).To(gbytes.Say(`releasing 1.2.3`))
+		})
+
+		Context("when another step declares its dependencies", func() {
+			var (
+				specPath     string
+				specContents []byte
+			)
+
+			BeforeEach(func() {
+				specPath = filepath.Join(workingDir, "ShakeAndBakeFile")
+
+				var err error
+				specContents, err = ioutil.ReadFile(specPath)
+				Expect(err).NotTo(HaveOccurred())
+
+				err = ioutil.WriteFile(specPath, append(specContents, []byte("\n\nRUN echo \"documenting\"\nNAME docs\nAFTER version\n")...), 0644)
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			AfterEach(func() {
+				ioutil.WriteFile(specPath, specContents, 0644)
+			})
+
+			It("still passes the variables on to the steps that follow", func() {
+				command := exec.Command(binaryPath, workingDir)
+				session, err := gexec.Start(command, GinkgoWriter, GinkgoWriter)
+				Expect(err).NotTo(HaveOccurred())
+				Eventually(session).Should(gexec.Exit(0))
+				Expect(session).To(gbytes.Say(`releasing 1.2.3`))
+			})
+		})
+	})
+
+	Describe("cleanup steps", func() {
+		BeforeEach(func() {
+			workingDir = fixturePath("cleanup")
+		})
+
+		It("executes them after a failed step and preserves its exit status", func() {
+			command := exec.Command(binaryPath, workingDir)
+			session, err := gexec.Start(command, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(3))
+
+			Expect(session).To(gbytes.Say(`starting server`))
+			Expect(session).To(gbytes.Say(`Step 2/2 : failing-step`))
+			Expect(session).To(gbytes.Say(`On failure 1/1`))
+			Expect(session).To(gbytes.Say(`collecting logs of failing-step \(3\)`))
+			Expect(session).To(gbytes.Say(`Finally 1/1`))
+			Expect(session).To(gbytes.Say(`stopping server`))
+			Expect(session).To(gbytes.Say(`Build failed \(exit status: 3\)`))
+		})
+
+		It("only executes the FINALLY steps after a successful build", func() {
+			command := exec.Command(binaryPath, "run", "start", workingDir)
+			session, err := gexec.Start(command, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+
+			Expect(session).To(gbytes.Say(`starting server`))
+			Expect(session).To(gbytes.Say(`Finally 1/1`))
+			Expect(session).To(gbytes.Say(`stopping server`))
+			Expect(session).To(gbytes.Say(`Build completed`))
+			Expect(session.Out.Contents()).NotTo(ContainSubstring("collecting logs"))
+		})
+	})
+
+	Describe("formatting", func() {
+		var (
+			specPath     string
+			specContents []byte
+		)
+
+		BeforeEach(func() {
+			workingDir = fixturePath("fmt")
+			specPath = filepath.Join(workingDir, "ShakeAndBakeFile")
+
+			var err error
+			specContents, err = ioutil.ReadFile(specPath)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			ioutil.WriteFile(specPath, specContents, 0644)
+		})
+
+		It("rewrites the ShakeAndBakeFile in the canonical layout", func() {
+			By("checking the original layout")
+
+			command := exec.Command(binaryPath, "fmt", "--check", workingDir)
+			session, err := gexec.Start(command, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(1))
+
+			Expect(session).To(gbytes.Say(`ShakeAndBakeFile is not formatted`))
+
+			By("formatting it")
+
+			command = exec.Command(binaryPath, "fmt", workingDir)
+			session, err = gexec.Start(command, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+
+			contents, err := ioutil.ReadFile(specPath)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(contents)).To(Equal("# greet everyone\nRUN echo hello \\\n    world\nNAME greet\n\nRUN echo done\n"))
+
+			By("checking the canonical layout")
+
+			command = exec.Command(binaryPath, "fmt", "--check", workingDir)
+			session, err = gexec.Start(command, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+		})
+	})
+
+	Describe("linting", func() {
+		BeforeEach(func() {
+			workingDir = fixturePath("lint")
+		})
+
+		It("reports the warnings for every step without executing it", func() {
+			command := exec.Command(binaryPath, "lint", workingDir)
+			session, err := gexec.Start(command, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(1))
+
+			Expect(session).To(gbytes.Say(`ShakeAndBakeFile:4:1: step 2 has no tracked inputs and will never be cached`))
+			Expect(session).To(gbytes.Say(`ShakeAndBakeFile:7:1: step 3 changes directory with cd outside of a subshell`))
+			Expect(session).To(gbytes.Say(`ShakeAndBakeFile:10:1: step 4 references ./dist which no earlier step produces`))
+			Expect(session).To(gbytes.Say(`3 warning\(s\) found`))
+			Expect(session.Out.Contents()).NotTo(ContainSubstring("building"))
+		})
+
+		It("reports the warnings as JSON when requested", func() {
+			command := exec.Command(binaryPath, "lint", "--json", workingDir)
+			session, err := gexec.Start(command, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(1))
+
+			var warnings []map[string]interface{}
+			err = json.Unmarshal(session.Out.Contents(), &warnings)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(warnings).To(HaveLen(3))
+			Expect(warnings[0]).To(Equal(map[string]interface{}{
+				"rule":     "untracked-inputs",
+				"step":     float64(2),
+				"name":     "announce",
+				"position": "ShakeAndBakeFile:4:1",
+				"message":  "step 2 has no tracked inputs and will never be cached; declare its INPUTS, or CACHE always if it does not depend on any file",
+			}))
+			Expect(warnings[1]["rule"]).To(Equal("change-directory"))
+			Expect(warnings[2]["rule"]).To(Equal("missing-path"))
+		})
+	})
+
+	Describe("background processes", func() {
+		BeforeEach(func() {
+			workingDir = fixturePath("background")
+		})
+
+		It("does not wait for the processes a step leaves running", func() {
+			command := exec.Command(binaryPath, workingDir)
+			session, err := gexec.Start(command, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session, 5*time.Second).Should(gexec.Exit(0))
+
+			Expect(session).To(gbytes.Say(`started server`))
+			Expect(session).To(gbytes.Say(`Step 2/2`))
+			Expect(session).To(gbytes.Say(`server is running`))
+		})
+	})
+
+	Describe("interrupted build", func() {
+		BeforeEach(func() {
+			workingDir = fixturePath("interrupt")
+		})
+
+		It("passes the signal on to the executing step and cleans up", func() {
+			command := exec.Command(binaryPath, workingDir)
+			session, err := gexec.Start(command, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+
+			Eventually(session).Should(gbytes.Say(`started`))
+			session.Interrupt()
+			Eventually(session, 5*time.Second).Should(gexec.Exit(130))
+
+			Expect(session).To(gbytes.Say(`Finally 1/1`))
+			Expect(session).To(gbytes.Say(`cleaning up`))
+			Expect(session).To(gbytes.Say(`Build interrupted \(interrupt\)`))
+			Expect(session.Out.Contents()).NotTo(ContainSubstring("never executed"))
+		})
+	})
+
+	Describe("stages", func() {
+		BeforeEach(func() {
+			workingDir = fixturePath("stages")
+		})
+
+		It("executes only the steps needed for the target stage", func() {
+			command := exec.Command(binaryPath, "--target", "release", workingDir)
+			session, err := gexec.Start(command, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+
+			Expect(session).To(gbytes.Say(`Step 1/3`))
+			Expect(session).To(gbytes.Say(`fetching dependencies`))
+			Expect(session).To(gbytes.Say(`Step 2/3`))
+			Expect(session).To(gbytes.Say(`building app`))
+			Expect(session).To(gbytes.Say(`Step 3/3`))
+			Expect(session).To(gbytes.Say(`packaging app`))
+			Expect(session.Out.Contents()).NotTo(ContainSubstring("building docs"))
+
+			By("targeting an unknown stage")
+
+			command = exec.Command(binaryPath, "--target", "deploy", workingDir)
+			session, err = gexec.Start(command, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(1))
+
+			Expect(session).To(gbytes.Say(`no stage named "deploy"`))
+		})
+
+		It("executes the steps of the target stage after the ones they follow", func() {
+			command := exec.Command(binaryPath, "-j", "2", "--target", "docs", workingDir)
+			session, err := gexec.Start(command, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+
+			Expect(session).To(gbytes.Say(`fetching dependencies`))
+			Expect(session).To(gbytes.Say(`building docs`))
+			Expect(session.Out.Contents()).NotTo(ContainSubstring("building app"))
+		})
+	})
+
+	Describe("declared outputs that are not produced", func() {
+		BeforeEach(func() {
+			workingDir = fixturePath("missing-output")
+		})
+
+		It("fails the step and executes the ON FAILURE steps", func() {
+			command := exec.Command(binaryPath, workingDir)
+			session, err := gexec.Start(command, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(1))
+
+			Expect(session).To(gbytes.Say(`building nothing`))
+			Expect(session).To(gbytes.Say(`On failure 1/1`))
+			Expect(session).To(gbytes.Say(`collecting logs of build \(1\)`))
+			Expect(session).To(gbytes.Say(`Build failed \(step did not produce declared output \./dist\)`))
+		})
+	})
 
 	Describe("missing ShakeAndBakeFile", func() {
 		BeforeEach(func() {
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/aemengo/snb/fs"
+	"github.com/aemengo/snb/lint"
+	"github.com/aemengo/snb/parser"
+)
+
+// lintSpec prints the warnings for the steps of a spec, as a JSON array
+// when asJSON is set, and exits with a failure if there are any
+func lintSpec(spec parser.Spec, fsClient *fs.FS, asJSON bool) {
+	warnings, err := lint.Check(spec, fsClient)
+	if err != nil {
+		fatal(err)
+	}
+
+	if asJSON {
+		output, err := json.MarshalIndent(warnings, "", "  ")
+		if err != nil {
+			fatal(err)
+		}
+
+		fmt.Println(string(output))
+	} else {
+		for _, warning := range warnings {
+			fmt.Println(warning)
+		}
+
+		if len(warnings) == 0 {
+			boldGreen.Println("No warnings found")
+		} else {
+			boldRed.Printf("\n%d warning(s) found\n", len(warnings))
+		}
+	}
+
+	if len(warnings) > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,194 @@
+// Package lint reports the mistakes in a spec that do not keep it from
+// executing, but keep snb from tracking its steps as intended
+package lint
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"unicode"
+
+	"github.com/aemengo/snb/fs"
+	"github.com/aemengo/snb/parser"
+)
+
+// The rules that a Warning can be raised by
+const (
+	// RuleUntrackedInputs is raised by a step that references no files,
+	// so that it is executed every time
+	RuleUntrackedInputs = "untracked-inputs"
+	// RuleChangeDirectory is raised by a step that changes directory,
+	// so that the paths it references are not the ones checksummed
+	RuleChangeDirectory = "change-directory"
+	// RuleMissingPath is raised by a step that references a path that
+	// does not exist and is not an output of a step before it
+	RuleMissingPath = "missing-path"
+)
+
+// Warning describes a mistake in a step of a spec
+type Warning struct {
+	Rule string `json:"rule"`
+	// Step is the number of the step, starting at 1
+	Step     int    `json:"step"`
+	Name     string `json:"name,omitempty"`
+	Position string `json:"position"`
+	Message  string `json:"message"`
+}
+
+func (w Warning) String() string {
+	return fmt.Sprintf("%s: %s", w.Position, w.Message)
+}
+
+// Check returns the warnings for the steps of a spec, in the order the
+// steps are declared. Nothing is executed: the inputs of each step are
+// detected as they would be before it executes.
+func Check(spec parser.Spec, fsClient *fs.FS) ([]Warning, error) {
+	warnings := []Warning{}
+
+	for index, step := range spec.Steps {
+		warn := func(rule, format string, args ...interface{}) {
+			warnings = append(warnings, Warning{
+				Rule:     rule,
+				Step:     index + 1,
+				Name:     step.Name,
+				Position: step.Pos.String(),
+				Message:  fmt.Sprintf("step %d ", index+1) + fmt.Sprintf(format, args...),
+			})
+		}
+
+		srcFiles, err := fsClient.GetSrcFiles(step)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(srcFiles) == 0 && len(step.Outputs) == 0 && step.Cache != parser.CacheAlways && step.Cache != parser.CacheNever {
+			warn(RuleUntrackedInputs, "has no tracked inputs and will never be cached; declare its INPUTS, or CACHE always if it does not depend on any file")
+		}
+
+		changes, outside := changesDirectory(step.Command)
+		if outside {
+			warn(RuleChangeDirectory, "changes directory with cd outside of a subshell, so the paths it references are not the ones tracked; use WORKDIR, or cd within ( )")
+		}
+
+		// the paths of a command that changes directory cannot be told
+		// apart from the ones relative to the step
+		for _, path := range referencedPaths(step, changes) {
+			found, err := exists(fsClient, step, path)
+			if err != nil {
+				return nil, err
+			}
+
+			if !found && !produced(spec, index, path) {
+				warn(RuleMissingPath, "references %s which no earlier step produces; declare it in the OUTPUTS of the step that creates it", path)
+			}
+		}
+	}
+
+	return warnings, nil
+}
+
+// changesDirectory reports whether a command invokes cd, and whether
+// it does so other than within a subshell. Quoting is not taken into
+// account.
+func changesDirectory(command string) (changes bool, outside bool) {
+	var (
+		depth = 0
+		start = true
+		word  strings.Builder
+	)
+
+	endWord := func() {
+		if start && word.String() == "cd" {
+			changes = true
+			outside = outside || depth == 0
+		}
+
+		if word.Len() > 0 {
+			start = false
+		}
+
+		word.Reset()
+	}
+
+	for _, char := range command + "\n" {
+		switch {
+		case unicode.IsSpace(char) && char != '\n':
+			endWord()
+		case strings.ContainsRune(";&|\n()", char):
+			endWord()
+
+			if char == '(' {
+				depth++
+			}
+
+			if char == ')' && depth > 0 {
+				depth--
+			}
+
+			start = true
+		default:
+			word.WriteRune(char)
+		}
+	}
+
+	return changes, outside
+}
+
+// referencedPaths returns the declared inputs of a step, or otherwise
+// the words of its command that are explicitly relative paths unless
+// they are to be ignored
+func referencedPaths(step parser.Step, ignoreCommand bool) []string {
+	if len(step.Inputs) > 0 || ignoreCommand {
+		return step.Inputs
+	}
+
+	words := strings.FieldsFunc(step.Command, func(char rune) bool {
+		return unicode.IsSpace(char) || strings.ContainsRune(";&|()<>", char)
+	})
+
+	var paths []string
+	for _, word := range words {
+		word = strings.Trim(word, `"'`)
+
+		if strings.Contains(word, "$") {
+			continue
+		}
+
+		if strings.HasPrefix(word, "./") || strings.HasPrefix(word, "../") {
+			paths = append(paths, word)
+		}
+	}
+
+	return paths
+}
+
+// exists reports whether a path, or glob pattern, referenced by a step
+// matches anything relative to the directory the step executes in
+func exists(fsClient *fs.FS, step parser.Step, path string) (bool, error) {
+	matches, err := fsClient.Glob(filepath.Join(step.WorkDir, path))
+	return len(matches) > 0, err
+}
+
+// produced reports whether a path referenced by a step is within, or
+// contains, the declared outputs of the step itself or a step it depends
+// on
+func produced(spec parser.Spec, index int, path string) bool {
+	path = filepath.Join(spec.Steps[index].WorkDir, path)
+
+	for _, producer := range append(spec.Dependencies(index), index) {
+		step := spec.Steps[producer]
+
+		for _, output := range step.Outputs {
+			output = filepath.Join(step.WorkDir, output)
+
+			if matched, _ := filepath.Match(output, path); matched ||
+				output == path ||
+				strings.HasPrefix(path, output+string(filepath.Separator)) ||
+				strings.HasPrefix(output, path+string(filepath.Separator)) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
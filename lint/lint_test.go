@@ -0,0 +1,161 @@
+package lint_test
+
+import (
+	. "github.com/aemengo/snb/lint"
+
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/aemengo/snb/fs"
+	"github.com/aemengo/snb/parser"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Lint", func() {
+	Describe("Check", func() {
+		var (
+			workingDir   string
+			fsClient     *fs.FS
+			specContents string
+		)
+
+		BeforeEach(func() {
+			var err error
+			workingDir, err = ioutil.TempDir("", "snb-lint-")
+			Expect(err).NotTo(HaveOccurred())
+
+			fsClient, err = fs.New(workingDir)
+			Expect(err).NotTo(HaveOccurred())
+
+			err = os.MkdirAll(filepath.Join(workingDir, "scripts"), os.ModePerm)
+			Expect(err).NotTo(HaveOccurred())
+
+			err = ioutil.WriteFile(filepath.Join(workingDir, "scripts", "build.sh"), []byte("make"), 0700)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(workingDir)
+		})
+
+		check := func() []Warning {
+			spec, err := parser.Parse("ShakeAndBakeFile", []byte(specContents), parser.Options{})
+			Expect(err).NotTo(HaveOccurred())
+
+			warnings, err := Check(spec, fsClient)
+			Expect(err).NotTo(HaveOccurred())
+			return warnings
+		}
+
+		Context("when every step is tracked", func() {
+			BeforeEach(func() {
+				specContents = `
+RUN ./scripts/build.sh
+OUTPUTS ./dist
+
+RUN tar -czf app.tgz ./dist/app
+CACHE never
+`
+			})
+
+			It("returns no warnings", func() {
+				Expect(check()).To(BeEmpty())
+			})
+		})
+
+		Context("when a step references no files", func() {
+			BeforeEach(func() {
+				specContents = `
+RUN ./scripts/build.sh
+NAME build
+
+RUN echo "done"
+NAME announce
+
+RUN date
+CACHE always
+`
+			})
+
+			It("warns that it will never be cached", func() {
+				Expect(check()).To(Equal([]Warning{{
+					Rule:     RuleUntrackedInputs,
+					Step:     2,
+					Name:     "announce",
+					Position: "ShakeAndBakeFile:5:1",
+					Message:  "step 2 has no tracked inputs and will never be cached; declare its INPUTS, or CACHE always if it does not depend on any file",
+				}}))
+			})
+		})
+
+		Context("when a step changes directory", func() {
+			BeforeEach(func() {
+				specContents = `
+RUN cd scripts && ./build.sh
+CACHE never
+
+RUN (cd scripts && ./build.sh)
+CACHE never
+
+RUN echo cd; ./scripts/build.sh
+
+RUN ./scripts/build.sh|cd /tmp
+`
+			})
+
+			It("warns unless it is within a subshell", func() {
+				warnings := check()
+				Expect(warnings).To(HaveLen(2))
+
+				Expect(warnings[0].Rule).To(Equal(RuleChangeDirectory))
+				Expect(warnings[0].Step).To(Equal(1))
+				Expect(warnings[0].Message).To(HavePrefix("step 1 changes directory with cd outside of a subshell"))
+
+				Expect(warnings[1].Rule).To(Equal(RuleChangeDirectory))
+				Expect(warnings[1].Step).To(Equal(4))
+			})
+		})
+
+		Context("when a step references a path that does not exist", func() {
+			BeforeEach(func() {
+				specContents = `
+RUN ./scripts/lint.sh
+NAME lint
+
+RUN ./scripts/build.sh
+NAME build
+OUTPUTS ./dist
+
+RUN ./scripts/build.sh ./dist/app "./build/app"
+AFTER lint
+
+RUN ./scripts/build.sh
+AFTER build
+INPUTS ./dist/*.tgz ./vendor
+`
+			})
+
+			It("warns unless an earlier step produces it", func() {
+				warnings := check()
+				Expect(warnings).To(HaveLen(5))
+
+				Expect(warnings[0].Rule).To(Equal(RuleUntrackedInputs))
+				Expect(warnings[0].Step).To(Equal(1))
+
+				Expect(warnings[1].Rule).To(Equal(RuleMissingPath))
+				Expect(warnings[1].Message).To(Equal("step 1 references ./scripts/lint.sh which no earlier step produces; declare it in the OUTPUTS of the step that creates it"))
+
+				Expect(warnings[2].Step).To(Equal(3))
+				Expect(warnings[2].Message).To(HavePrefix("step 3 references ./dist/app which no earlier step produces"))
+
+				Expect(warnings[3].Step).To(Equal(3))
+				Expect(warnings[3].Message).To(HavePrefix("step 3 references ./build/app which no earlier step produces"))
+
+				Expect(warnings[4].Step).To(Equal(4))
+				Expect(warnings[4].Message).To(HavePrefix("step 4 references ./vendor which no earlier step produces"))
+			})
+		})
+	})
+})
@@ -1,44 +1,107 @@
 package main
 
 import (
-	"bufio"
+	"errors"
+	"flag"
+	"fmt"
 	"github.com/aemengo/snb/db"
+	"github.com/aemengo/snb/fs"
+	"github.com/aemengo/snb/parser"
 	"github.com/fatih/color"
-	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
-	"syscall"
-	"time"
-	"github.com/aemengo/snb/fs"
 	"path/filepath"
-	"fmt"
-	"github.com/aemengo/snb/parser"
 	"strings"
+	"syscall"
+	"time"
 )
 
+// timeoutExitCode is the exit status of a build that fails because a step
+// timed out, as with timeout(1)
+const timeoutExitCode = 124
+
 var (
-	boldWhite = color.New(color.FgWhite, color.Bold)
-	boldGreen = color.New(color.FgGreen, color.Bold)
-	boldRed   = color.New(color.FgRed, color.Bold)
-	white     = color.New(color.FgWhite)
-	red       = color.New(color.FgRed)
-	logPrefix = " ---> "
+	boldWhite  = color.New(color.FgWhite, color.Bold)
+	boldGreen  = color.New(color.FgGreen, color.Bold)
+	boldRed    = color.New(color.FgRed, color.Bold)
+	white      = color.New(color.FgWhite)
+	red        = color.New(color.FgRed)
+	logPrefix  = " ---> "
 	workingDir = "."
 )
 
 func main() {
 	startTime := time.Now()
 
-	switch len(os.Args) {
-	case 1:
+	var (
+		args      = os.Args[1:]
+		stepName  string
+		withDeps  bool
+		noChain   bool
+		jobs      int
+		timeout   time.Duration
+		target    string
+		buildArgs = buildArgFlag{}
+		format    bool
+		check     bool
+		linting   bool
+		asJSON    bool
+	)
+
+	flags := flag.NewFlagSet("snb", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	flags.BoolVar(&noChain, "no-chain", false, "")
+	flags.IntVar(&jobs, "j", 1, "")
+	flags.DurationVar(&timeout, "timeout", 0, "")
+	flags.StringVar(&target, "target", "", "")
+	flags.Var(buildArgs, "build-arg", "")
+
+	if len(args) > 0 && args[0] == "run" {
+		flags.BoolVar(&withDeps, "deps", false, "")
+
+		if err := flags.Parse(args[1:]); err != nil || flags.NArg() == 0 {
+			showUsage()
+		}
+
+		stepName = flags.Arg(0)
+		args = flags.Args()[1:]
+	} else if len(args) > 0 && args[0] == "fmt" {
+		flags.BoolVar(&check, "check", false, "")
+
+		if err := flags.Parse(args[1:]); err != nil {
+			showUsage()
+		}
+
+		format = true
+		args = flags.Args()
+	} else if len(args) > 0 && args[0] == "lint" {
+		flags.BoolVar(&asJSON, "json", false, "")
+
+		if err := flags.Parse(args[1:]); err != nil {
+			showUsage()
+		}
+
+		linting = true
+		args = flags.Args()
+	} else {
+		if err := flags.Parse(args); err != nil {
+			showUsage()
+		}
+
+		args = flags.Args()
+	}
+
+	switch len(args) {
+	case 0:
 		workingDir, _ = filepath.Abs(workingDir)
-	case 2:
-		if strings.HasPrefix(os.Args[1], "-") {
+	case 1:
+		if strings.HasPrefix(args[0], "-") {
 			showUsage()
 		}
 
 		var err error
-		workingDir, err = filepath.Abs(os.Args[1])
+		workingDir, err = filepath.Abs(args[0])
 		if err != nil {
 			fatal(err)
 		}
@@ -51,64 +114,72 @@ func main() {
 		fatal(err)
 	}
 
-	if !fsClient.Exists("ShakeAndBakeFile") {
+	if format {
+		formatSpec(fsClient, check)
+		return
+	}
+
+	// a snb.yaml spec is only considered in the absence of a
+	// ShakeAndBakeFile
+	specFile, parse := "ShakeAndBakeFile", parser.Parse
+	if !fsClient.Exists(specFile) && fsClient.Exists("snb.yaml") {
+		specFile, parse = "snb.yaml", parser.ParseYAML
+	}
+
+	if !fsClient.Exists(specFile) {
 		fatal("ShakeAndBakeFile not found. please execute in directory containing spec, or pass the working directory in as the only argument")
 	}
 
-	contents, err := fsClient.Get("ShakeAndBakeFile")
+	contents, err := fsClient.Get(specFile)
 	if err != nil {
 		fatal(err)
 	}
 
-	spec, err := parser.Parse(contents)
+	spec, err := parse(specFile, contents, parser.Options{
+		BuildArgs: buildArgs,
+		ReadFile:  fsClient.Get,
+		Glob:      fsClient.Glob,
+	})
 	if err != nil {
 		fatal(err)
 	}
 
+	if linting {
+		lintSpec(spec, fsClient, asJSON)
+		return
+	}
+
 	dbClient, err := db.New(filepath.Join(workingDir, ".snb"))
 	if err != nil {
 		fatal(err)
 	}
 	defer dbClient.Close()
 
-	for index, step := range spec.Steps {
-		boldWhite.Printf("Step %d/%d : %s\n", index+1, len(spec.Steps), step)
-
-		srcFiles, err := fsClient.GetSrcFiles(step)
-		if err != nil {
-			fatal(err)
-		}
-
-		ok, err := dbClient.IsCached(step, index, srcFiles)
-		if err != nil {
-			fatal(err)
-		}
+	indexes, err := selectSteps(spec, stepName, withDeps, target)
+	if err != nil {
+		fatal(err)
+	}
 
-		if ok {
-			white.Println(logPrefix + "Using cache")
-			continue
-		}
+	executing.forward()
 
-		err = executeStep(step)
-		if err != nil {
-			exitCode, ok := exitCode(err)
-			if ok {
-				boldRed.Printf("\nBuild failed (exit status: %d)\n", exitCode)
-			} else {
-				boldRed.Printf("\nBuild failed\n")
-			}
-			os.Exit(exitCode)
-		}
+	r := newRunner(spec, fsClient, dbClient, indexes, !noChain, jobs, timeout)
+	err = r.cleanUp(r.run())
+	if sig, ok := executing.signal(); ok {
+		boldRed.Printf("\nBuild interrupted (%s)\n", sig)
+		os.Exit(128 + int(sig))
+	}
 
-		srcFiles, err = fsClient.GetSrcFiles(step)
-		if err != nil {
-			fatal(err)
+	if failure, ok := err.(*stepFailure); ok {
+		if code, ok := exitCode(failure.err); ok {
+			boldRed.Printf("\nBuild failed (exit status: %d)\n", code)
+		} else {
+			boldRed.Printf("\nBuild failed (%s)\n", failure.err)
 		}
+		os.Exit(failure.exitCode())
+	}
 
-		err = dbClient.Save(step, index, srcFiles)
-		if err != nil {
-			fatal(err)
-		}
+	if err != nil {
+		fatal(err)
 	}
 
 	endTime := time.Now()
@@ -116,31 +187,49 @@ func main() {
 	boldGreen.Printf("\nBuild completed (%f seconds)\n", endTime.Sub(startTime).Seconds())
 }
 
-func executeStep(step string) error {
-	white.Println(logPrefix + "Running")
-	command := exec.Command("bash", "-c", step)
-	command.Dir = workingDir
-	command.Env = os.Environ()
+// selectSteps returns the indexes of the steps to execute: every step of
+// the spec, the ones needed for the target stage, or the named one
+// optionally preceded by its dependencies
+func selectSteps(spec parser.Spec, name string, withDeps bool, target string) ([]int, error) {
+	if name != "" && target != "" {
+		return nil, errors.New("--target cannot be used with snb run")
+	}
+
+	if target != "" {
+		return spec.Target(target)
+	}
 
-	stdout, _ := command.StdoutPipe()
-	stderr, _ := command.StderrPipe()
+	if name == "" {
+		return spec.Order(), nil
+	}
 
-	err := command.Start()
+	index, err := spec.Lookup(name)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	if !withDeps {
+		return []int{index}, nil
 	}
 
-	go report(stdout, white)
-	go report(stderr, red)
+	return append(spec.Dependencies(index), index), nil
+}
+
+// buildArgFlag collects the NAME=VALUE pairs of repeated --build-arg flags
+type buildArgFlag map[string]string
 
-	return command.Wait()
+func (f buildArgFlag) String() string {
+	return ""
 }
 
-func report(stdout io.ReadCloser, clr *color.Color) {
-	scanner := bufio.NewScanner(stdout)
-	for scanner.Scan() {
-		clr.Println(scanner.Text())
+func (f buildArgFlag) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("build argument %q is not in NAME=VALUE form", value)
 	}
+
+	f[parts[0]] = parts[1]
+	return nil
 }
 
 func exitCode(err error) (int, bool) {
@@ -158,15 +247,37 @@ func exitCode(err error) (int, bool) {
 }
 
 func fatal(message interface{}) {
-	fmt.Printf(color.RedString("Error") + ": %s.\n", message)
+	fmt.Printf(color.RedString("Error")+": %s.\n", message)
 	os.Exit(1)
 }
 
 func showUsage() {
 	fmt.Println(`
-USAGE:	snb [PATH]
+USAGE:	snb [OPTIONS] [PATH]
+	snb run [OPTIONS] [--deps] STEP [PATH]
+	snb fmt [--check] [PATH]
+	snb lint [OPTIONS] [--json] [PATH]
+
+Build an image from a ShakeAndBakeFile, or a snb.yaml in its absence
 
-Build an image from a ShakeAndBakeFile
+COMMANDS:
+	run	Execute only the step with the given NAME, along with
+		the steps it depends on when --deps is passed
+	fmt	Rewrite the ShakeAndBakeFile in its canonical layout,
+		or only fail if it is not in it when --check is passed
+	lint	Report the steps that will not be tracked as intended,
+		as a JSON array when --json is passed, without executing them
+
+OPTIONS:
+	-j N		Execute up to N independent steps at once
+	--target STAGE	Execute only the steps needed for the given STAGE
+	--timeout DURATION
+			Terminate any step without a TIMEOUT that executes
+			for longer than DURATION, e.g. 10m
+	--build-arg NAME=VALUE
+			Override the default value of an ARG, may be repeated
+	--no-chain	Do not execute a cached step again when a step it
+			depends on has been executed
 	`)
 	os.Exit(1)
-}
\ No newline at end of file
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/fatih/color"
+)
+
+// stdoutMutex serializes the flushing of grouped output
+var stdoutMutex sync.Mutex
+
+// output writes the log of a single step. When grouped, the log is held
+// back until the step completes and then written all at once, so that
+// the logs of steps running concurrently do not interleave.
+type output struct {
+	mutex  sync.Mutex
+	buffer *bytes.Buffer
+}
+
+func newOutput(grouped bool) *output {
+	if grouped {
+		return &output{buffer: &bytes.Buffer{}}
+	}
+
+	return &output{}
+}
+
+func (o *output) printf(clr *color.Color, format string, args ...interface{}) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	if o.buffer != nil {
+		clr.Fprintf(o.buffer, format, args...)
+		return
+	}
+
+	clr.Printf(format, args...)
+}
+
+func (o *output) println(clr *color.Color, text string) {
+	o.printf(clr, "%s\n", text)
+}
+
+func (o *output) flush() {
+	if o.buffer == nil {
+		return
+	}
+
+	stdoutMutex.Lock()
+	defer stdoutMutex.Unlock()
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	color.Output.Write(o.buffer.Bytes())
+	o.buffer.Reset()
+}
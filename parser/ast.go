@@ -0,0 +1,82 @@
+package parser
+
+import (
+	"fmt"
+	"regexp"
+)
+
+var continuation = regexp.MustCompile(`\\\s*\n\s*`)
+
+// Position locates a token or node within a spec file
+type Position struct {
+	File   string
+	Line   int
+	Column int
+	// Path locates a step within a structured spec such as snb.yaml,
+	// whose positions are not known by line
+	Path string
+}
+
+func (p Position) String() string {
+	if p.Path != "" {
+		return fmt.Sprintf("%s:%s", p.File, p.Path)
+	}
+
+	return fmt.Sprintf("%s:%d:%d", p.File, p.Line, p.Column)
+}
+
+// Error is a parse error annotated with the position it occurred at
+type Error struct {
+	Pos     Position
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Pos, e.Message)
+}
+
+func errorf(pos Position, format string, args ...interface{}) error {
+	return &Error{Pos: pos, Message: fmt.Sprintf(format, args...)}
+}
+
+// Node is a single directive of a spec file, such as a RUN step
+type Node struct {
+	Directive string
+	// Args is the text following the directive, where lines continued
+	// with a backslash are kept as written
+	Args string
+	// Heredoc is set when Args opens a heredoc, whose lines are kept
+	// in Body with leading tabs stripped for <<-, as in the shell. Raw
+	// holds the same lines up to and including the delimiter, exactly
+	// as written.
+	Heredoc  bool
+	Body     string
+	Raw      string
+	Pos      Position
+	Comments []string
+	// Nodes are the ones contained by a block directive such as
+	// FOREACH, and End the directive closing it
+	Nodes []*Node
+	End   *Node
+}
+
+// value returns the arguments of the node with any line continuations
+// joined into a single line
+func (n *Node) value() string {
+	return continuation.ReplaceAllString(n.Args, " ")
+}
+
+// quoted reports whether the node opens a heredoc with a quoted delimiter,
+// such as <<'EOF'
+func (n *Node) quoted() bool {
+	heredoc := heredocPattern.FindStringSubmatch(n.Args)
+	return n.Heredoc && heredoc != nil && heredoc[2] != ""
+}
+
+// AST is the parsed representation of a spec file
+type AST struct {
+	File  string
+	Nodes []*Node
+	// Comments are the ones following the last node
+	Comments []string
+}
@@ -0,0 +1,159 @@
+package parser
+
+import (
+	"bytes"
+	"strings"
+	"unicode"
+)
+
+// continuationIndent is the indentation of continued lines relative to
+// the directive they continue, and blockIndent that of the directives
+// within a block
+const (
+	continuationIndent = "    "
+	blockIndent        = "  "
+)
+
+// Format renders a syntax tree in the canonical layout of a spec file:
+// directives in upper case, continued lines and the contents of blocks
+// indented, and exactly one blank line between steps. Comments are kept
+// above the directive they precede, including those that were within
+// its continued lines, and the body and delimiter of a heredoc are kept
+// exactly as written.
+func Format(ast *AST) []byte {
+	var buf bytes.Buffer
+	formatNodes(&buf, ast.Nodes, "")
+
+	if len(ast.Comments) > 0 && len(ast.Nodes) > 0 {
+		buf.WriteString("\n")
+	}
+
+	for _, comment := range ast.Comments {
+		buf.WriteString(comment + "\n")
+	}
+
+	return buf.Bytes()
+}
+
+func formatNodes(buf *bytes.Buffer, nodes []*Node, indent string) {
+	for index, node := range nodes {
+		if index > 0 && !clauses[node.Directive] && endsStep(nodes[index-1]) {
+			buf.WriteString("\n")
+		}
+
+		formatNode(buf, node, indent)
+	}
+}
+
+// endsStep reports whether the node may be the last one of a step, so
+// that a blank line separates it from any directive but a clause
+func endsStep(node *Node) bool {
+	return node.Directive == directiveRun ||
+		node.Directive == directiveCall ||
+		clauses[node.Directive] ||
+		blocks[node.Directive]
+}
+
+func formatNode(buf *bytes.Buffer, node *Node, indent string) {
+	for _, comment := range node.Comments {
+		buf.WriteString(indent + comment + "\n")
+	}
+
+	args := node.Args
+	if node.Directive == directiveOn {
+		args = strings.ToUpper(args)
+	}
+
+	if words := strings.Fields(args); node.Directive == directiveStage && len(words) > 1 {
+		words[1] = strings.ToUpper(words[1])
+		args = strings.Join(words, " ")
+	}
+
+	buf.WriteString(indent + node.Directive)
+	if args != "" {
+		buf.WriteString(" " + formatArgs(args, indent))
+	}
+	buf.WriteString("\n")
+
+	if node.Heredoc {
+		buf.WriteString(node.Raw + "\n")
+	}
+
+	if blocks[node.Directive] {
+		formatNodes(buf, node.Nodes, indent+blockIndent)
+
+		if node.End != nil {
+			for _, comment := range node.End.Comments {
+				buf.WriteString(indent + blockIndent + comment + "\n")
+			}
+		}
+
+		buf.WriteString(indent + directiveEnd + "\n")
+	}
+}
+
+// formatArgs indents every continued line of the arguments of a node,
+// and separates the backslash continuing a line by a single space. A
+// line continued in the middle of a word is kept as written, since the
+// shell would otherwise see two words, and so is the whitespace around
+// a continuation within quotes, which is part of the quoted string.
+func formatArgs(args, indent string) string {
+	var (
+		lines = strings.Split(args, "\n")
+		quote rune
+	)
+
+	for index, line := range lines {
+		quoted := quote != 0
+		quote = openQuote(line, quote)
+
+		if quote == 0 {
+			line = strings.TrimRightFunc(line, unicode.IsSpace)
+		}
+
+		if index > 0 && !quoted && isSpaceAround(lines[index-1], lines[index]) {
+			line = indent + continuationIndent + strings.TrimLeftFunc(line, unicode.IsSpace)
+		}
+
+		if quote == 0 && isContinued(line) && (index == len(lines)-1 || isSpaceAround(line, lines[index+1])) {
+			line = strings.TrimRightFunc(strings.TrimSuffix(line, "\\"), unicode.IsSpace)
+			if strings.TrimSpace(line) != "" {
+				line += " "
+			}
+			line += "\\"
+		}
+
+		lines[index] = line
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// openQuote returns the quote left open at the end of a line, given the
+// one open at its start, or zero if there is none
+func openQuote(line string, quote rune) rune {
+	escaped := false
+
+	for _, r := range line {
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped = true
+		case quote == 0 && (r == '\'' || r == '"'):
+			quote = r
+		case r == quote:
+			quote = 0
+		}
+	}
+
+	return quote
+}
+
+// isSpaceAround reports whether a continued line and the one continuing
+// it are separated by whitespace on either side of the backslash
+func isSpaceAround(continued, next string) bool {
+	continued = strings.TrimSuffix(strings.TrimRightFunc(continued, unicode.IsSpace), "\\")
+	return strings.TrimRightFunc(continued, unicode.IsSpace) != continued ||
+		strings.TrimLeftFunc(next, unicode.IsSpace) != next
+}
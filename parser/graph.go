@@ -0,0 +1,254 @@
+package parser
+
+import "fmt"
+
+// Needs returns the indexes of the steps that the step at the given index
+// directly depends on. A step that declares its dependencies with AFTER
+// depends on those steps alone, and any other step depends on the one
+// declared before it, skipping the steps of stages its own stage does not
+// depend on. A step also depends on every step of the stages its own stage
+// is declared to run after.
+func (s Spec) Needs(index int) []int {
+	var needs []int
+	if len(s.Steps[index].After) == 0 {
+		if i, ok := s.predecessor(index); ok {
+			needs = append(needs, i)
+		}
+	}
+
+	for _, name := range s.Steps[index].After {
+		if i, err := s.Lookup(name); err == nil {
+			needs = append(needs, i)
+		}
+	}
+
+	if stage, ok := s.stage(s.Steps[index].Stage); ok && len(stage.After) > 0 {
+		for i, step := range s.Steps {
+			if contains(stage.After, step.Stage) && !containsIndex(needs, i) {
+				needs = append(needs, i)
+			}
+		}
+	}
+
+	return needs
+}
+
+// Target returns the indexes of the steps needed for the named stage, in
+// the order they would execute: the steps of the stage and of the stages
+// it depends on, the steps declared before any stage, and the steps that
+// any of them are declared to run after
+func (s Spec) Target(name string) ([]int, error) {
+	if _, ok := s.stage(name); !ok {
+		return nil, fmt.Errorf("no stage named %q", name)
+	}
+
+	stages := s.requiredStages(name)
+
+	required := map[int]bool{}
+	for index, step := range s.Steps {
+		if !stages[step.Stage] {
+			continue
+		}
+
+		required[index] = true
+		for _, dependency := range s.Dependencies(index) {
+			required[dependency] = true
+		}
+	}
+
+	var indexes []int
+	for _, i := range s.Order() {
+		if required[i] {
+			indexes = append(indexes, i)
+		}
+	}
+
+	return indexes, nil
+}
+
+// predecessor returns the index of the nearest step declared before the
+// one at the given index that belongs to a stage it requires
+func (s Spec) predecessor(index int) (int, bool) {
+	stages := s.requiredStages(s.Steps[index].Stage)
+
+	for i := index - 1; i >= 0; i-- {
+		if stages[s.Steps[i].Stage] {
+			return i, true
+		}
+	}
+
+	return 0, false
+}
+
+// requiredStages returns the named stage, the stages it depends on and
+// the unnamed stage of the steps declared before any STAGE
+func (s Spec) requiredStages(name string) map[string]bool {
+	var (
+		stages = map[string]bool{"": true}
+		visit  func(name string)
+	)
+
+	visit = func(name string) {
+		stages[name] = true
+
+		stage, _ := s.stage(name)
+		for _, dependency := range stage.After {
+			if !stages[dependency] {
+				visit(dependency)
+			}
+		}
+	}
+	visit(name)
+
+	return stages
+}
+
+func (s Spec) stage(name string) (Stage, bool) {
+	for _, stage := range s.Stages {
+		if stage.Name == name {
+			return stage, true
+		}
+	}
+
+	return Stage{}, false
+}
+
+func containsIndex(indexes []int, index int) bool {
+	for _, i := range indexes {
+		if i == index {
+			return true
+		}
+	}
+
+	return false
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Dependencies returns the indexes of every step that must have run
+// before the step at the given index, in the order they would execute
+func (s Spec) Dependencies(index int) []int {
+	var (
+		required = map[int]bool{}
+		visit    func(index int)
+	)
+
+	visit = func(index int) {
+		for _, need := range s.Needs(index) {
+			if !required[need] {
+				required[need] = true
+				visit(need)
+			}
+		}
+	}
+	visit(index)
+
+	var indexes []int
+	for _, i := range s.Order() {
+		if required[i] {
+			indexes = append(indexes, i)
+		}
+	}
+
+	return indexes
+}
+
+// Order returns the indexes of every step in an order that satisfies
+// their dependencies, keeping to the order they are declared in
+// wherever possible
+func (s Spec) Order() []int {
+	var (
+		indexes = make([]int, 0, len(s.Steps))
+		done    = make([]bool, len(s.Steps))
+	)
+
+	for len(indexes) < len(s.Steps) {
+		progressed := false
+
+		for index := range s.Steps {
+			if done[index] || !s.ready(index, done) {
+				continue
+			}
+
+			done[index] = true
+			indexes = append(indexes, index)
+			progressed = true
+			break
+		}
+
+		// only a cyclic spec, which the parser rejects, can stall
+		if !progressed {
+			break
+		}
+	}
+
+	return indexes
+}
+
+func (s Spec) ready(index int, done []bool) bool {
+	for _, need := range s.Needs(index) {
+		if !done[need] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// findCycle returns the indexes of the steps forming a dependency cycle,
+// starting and ending with the same step, or nil if there is none
+func (s Spec) findCycle() []int {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+
+	var (
+		states = make([]int, len(s.Steps))
+		path   []int
+		visit  func(index int) []int
+	)
+
+	visit = func(index int) []int {
+		states[index] = visiting
+		path = append(path, index)
+
+		for _, need := range s.Needs(index) {
+			switch states[need] {
+			case visiting:
+				for i, step := range path {
+					if step == need {
+						return append(append([]int{}, path[i:]...), need)
+					}
+				}
+			case unvisited:
+				if cycle := visit(need); cycle != nil {
+					return cycle
+				}
+			}
+		}
+
+		path = path[:len(path)-1]
+		states[index] = visited
+		return nil
+	}
+
+	for index := range s.Steps {
+		if states[index] == unvisited {
+			if cycle := visit(index); cycle != nil {
+				return cycle
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,67 @@
+package parser
+
+import (
+	"regexp"
+	"strings"
+)
+
+// interpolationPattern matches ${VAR} and ${VAR:-default}, along with
+// an optional backslash escaping them
+var interpolationPattern = regexp.MustCompile(`\\?\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// expand replaces the ${VAR} and ${VAR:-default} references within text
+// with the value of the variable. A reference to a variable that is not
+// set, and has no default, is left for the shell to expand, as is any
+// reference escaped with a backslash.
+func (b *builder) expand(text string) string {
+	return interpolationPattern.ReplaceAllStringFunc(text, func(match string) string {
+		if strings.HasPrefix(match, `\`) {
+			return match[1:]
+		}
+
+		var (
+			groups     = interpolationPattern.FindStringSubmatch(match)
+			value, ok  = b.lookup(groups[1])
+			hasDefault = groups[2] != ""
+		)
+
+		switch {
+		case hasDefault && value == "":
+			return groups[3]
+		case ok:
+			return value
+		default:
+			return match
+		}
+	})
+}
+
+// references reports whether text refers to the variable with ${VAR}
+func references(text, key string) bool {
+	for _, groups := range interpolationPattern.FindAllStringSubmatch(text, -1) {
+		if !strings.HasPrefix(groups[0], `\`) && groups[1] == key {
+			return true
+		}
+	}
+
+	return false
+}
+
+// lookup returns the value of the variable of an enclosing FOREACH or
+// DEFINE directive, of a variable declared with ENV or ARG, or otherwise of the
+// environment that snb is invoked in
+func (b *builder) lookup(key string) (string, bool) {
+	for index := len(b.bindings) - 1; index >= 0; index-- {
+		if b.bindings[index].key == key {
+			return b.bindings[index].value, true
+		}
+	}
+
+	for _, entry := range b.env {
+		if strings.HasPrefix(entry, key+"=") {
+			return strings.TrimPrefix(entry, key+"="), true
+		}
+	}
+
+	return b.lookupEnv(key)
+}
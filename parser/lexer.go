@@ -0,0 +1,220 @@
+package parser
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// heredocPattern matches the text opening a heredoc, such as <<EOF,
+// <<-EOF or <<"EOF"
+var heredocPattern = regexp.MustCompile(`^<<(-?)(["']?)([A-Za-z_][A-Za-z0-9_]*)(["']?)$`)
+
+type tokenType int
+
+const (
+	// tokenWord is the first word of a line
+	tokenWord tokenType = iota
+	// tokenText is the remainder of a line following its first word,
+	// including any lines it is continued onto
+	tokenText
+	// tokenNewline terminates every line that starts with a word
+	tokenNewline
+	// tokenComment is a line starting with #
+	tokenComment
+	// tokenBlank is an empty or whitespace-only line
+	tokenBlank
+	// tokenHeredoc is the body of a heredoc opened by the text of the
+	// line preceding it
+	tokenHeredoc
+	tokenEOF
+)
+
+type token struct {
+	typ   tokenType
+	value string
+	pos   Position
+	// comments are the ones skipped over within the continued lines
+	// of a text token
+	comments []string
+	// raw is the body of a heredoc token along with its delimiter,
+	// exactly as written
+	raw string
+}
+
+// lex splits the contents of a spec file into line-oriented tokens.
+// Every line starting with a word is emitted as the word, the (possibly
+// empty) text that follows it and a newline. A line ending with a
+// backslash is continued onto the next line, skipping over any blank
+// lines and comments in between. A line whose text opens a heredoc is
+// followed by the body of the heredoc, kept exactly as written.
+func lex(file string, contents []byte) ([]token, error) {
+	var (
+		tokens []token
+		lines  = strings.Split(string(contents), "\n")
+	)
+
+	for index := 0; index < len(lines); index++ {
+		var (
+			line    = strings.TrimSuffix(lines[index], "\r")
+			trimmed = strings.TrimSpace(line)
+			pos     = Position{File: file, Line: index + 1, Column: 1}
+		)
+
+		if trimmed == "" {
+			tokens = append(tokens, token{typ: tokenBlank, pos: pos})
+			continue
+		}
+
+		start := strings.IndexFunc(line, isNotSpace)
+		pos.Column = start + 1
+
+		if strings.HasPrefix(trimmed, "#") {
+			tokens = append(tokens, token{typ: tokenComment, value: trimmed, pos: pos})
+			continue
+		}
+
+		end := strings.IndexFunc(line[start:], unicode.IsSpace)
+		if end == -1 {
+			end = len(line)
+		} else {
+			end += start
+		}
+
+		tokens = append(tokens, token{typ: tokenWord, value: line[start:end], pos: pos})
+		textPos := Position{File: file, Line: index + 1, Column: end + 1}
+
+		var (
+			text     = line[end:]
+			comments []string
+		)
+
+		for isContinued(text) {
+			next := index + 1
+			for next < len(lines) && isSkippedInContinuation(lines[next]) {
+				if comment := strings.TrimSpace(lines[next]); comment != "" {
+					comments = append(comments, comment)
+				}
+				next++
+			}
+
+			if next == len(lines) {
+				text = strings.TrimSuffix(strings.TrimRightFunc(text, unicode.IsSpace), "\\")
+				break
+			}
+
+			text += "\n" + strings.TrimSuffix(lines[next], "\r")
+			index = next
+		}
+
+		tokens = append(tokens, token{typ: tokenText, value: text, pos: textPos, comments: comments})
+
+		if heredoc := heredocPattern.FindStringSubmatch(strings.TrimSpace(text)); heredoc != nil && heredoc[2] == heredoc[4] {
+			body, end, ok := readHeredoc(lines, index+1, heredoc[3], heredoc[1] == "-")
+			if !ok {
+				return nil, errorf(textPos, "heredoc is not terminated by %s", heredoc[3])
+			}
+
+			var raw []string
+			for _, line := range lines[index+1 : end+1] {
+				raw = append(raw, strings.TrimSuffix(line, "\r"))
+			}
+
+			tokens = append(tokens, token{typ: tokenHeredoc, value: body, raw: strings.Join(raw, "\n"), pos: Position{File: file, Line: index + 2, Column: 1}})
+			index = end
+		}
+
+		tokens = append(tokens, token{typ: tokenNewline, pos: Position{File: file, Line: index + 1, Column: len(lines[index]) + 1}})
+	}
+
+	return append(tokens, token{typ: tokenEOF, pos: Position{File: file, Line: len(lines), Column: 1}}), nil
+}
+
+// readHeredoc collects the lines starting at the given index up to the
+// one consisting of the delimiter, returning them along with the index
+// of the delimiter. Like the shell, leading tabs are stripped from every
+// line when stripTabs is set.
+func readHeredoc(lines []string, start int, delimiter string, stripTabs bool) (string, int, bool) {
+	var body []string
+
+	for index := start; index < len(lines); index++ {
+		line := strings.TrimSuffix(lines[index], "\r")
+		if stripTabs {
+			line = strings.TrimLeft(line, "\t")
+		}
+
+		if line == delimiter {
+			return strings.Join(body, "\n"), index, true
+		}
+
+		body = append(body, line)
+	}
+
+	return "", 0, false
+}
+
+func isContinued(text string) bool {
+	return strings.HasSuffix(strings.TrimRightFunc(text, unicode.IsSpace), "\\")
+}
+
+func isSkippedInContinuation(line string) bool {
+	trimmed := strings.TrimSpace(line)
+	return trimmed == "" || strings.HasPrefix(trimmed, "#")
+}
+
+func isNotSpace(r rune) bool {
+	return !unicode.IsSpace(r)
+}
+
+// splitWords splits text into words separated by whitespace, where
+// quotes group a word containing whitespace and backslashes escape the
+// character that follows them
+func splitWords(text string) ([]string, error) {
+	var (
+		words   []string
+		word    strings.Builder
+		inWord  bool
+		quote   rune
+		escaped bool
+	)
+
+	for _, r := range text {
+		switch {
+		case escaped:
+			word.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped = true
+			inWord = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '"' || r == '\'':
+			quote = r
+			inWord = true
+		case unicode.IsSpace(r):
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote", quote)
+	}
+
+	if inWord {
+		words = append(words, word.String())
+	}
+
+	return words, nil
+}
@@ -1,26 +1,286 @@
 package parser
 
-import (
-	"regexp"
-	"strings"
+import "strings"
+
+const (
+	directiveRun     = "RUN"
+	directiveName    = "NAME"
+	directiveInputs  = "INPUTS"
+	directiveOutputs = "OUTPUTS"
+	directiveAfter   = "AFTER"
+	directiveEnv     = "ENV"
+	directiveArg     = "ARG"
+	directiveWorkDir = "WORKDIR"
+	directiveInclude = "INCLUDE"
+	directiveShell   = "SHELL"
+	directiveTimeout = "TIMEOUT"
+	directiveRetry   = "RETRY"
+	directiveCache   = "CACHE"
+	directiveForeach = "FOREACH"
+	directiveDefine  = "DEFINE"
+	directiveCall    = "CALL"
+	directiveFinally = "FINALLY"
+	directiveOn      = "ON"
+	directiveEnd     = "END"
+	directiveStage   = "STAGE"
 )
 
-type Spec struct {
-	Steps []string
+var directives = map[string]bool{
+	directiveRun:     true,
+	directiveName:    true,
+	directiveInputs:  true,
+	directiveOutputs: true,
+	directiveAfter:   true,
+	directiveEnv:     true,
+	directiveArg:     true,
+	directiveWorkDir: true,
+	directiveInclude: true,
+	directiveShell:   true,
+	directiveTimeout: true,
+	directiveRetry:   true,
+	directiveCache:   true,
+	directiveForeach: true,
+	directiveDefine:  true,
+	directiveCall:    true,
+	directiveFinally: true,
+	directiveOn:      true,
+	directiveEnd:     true,
+	directiveStage:   true,
 }
 
-func Parse(specFile []byte) (Spec, error) {
-	stepRegex := `(?msU)RUN(.*)(?:^\s*$|\z)`
-	matches := regexp.MustCompile(stepRegex).FindAllStringSubmatch(string(specFile), -1)
+// blocks are the directives whose nodes contain the ones that follow
+// them, up to an END directive
+var blocks = map[string]bool{
+	directiveForeach: true,
+	directiveDefine:  true,
+	directiveFinally: true,
+	directiveOn:      true,
+}
 
-	if len(matches) == 0 {
-		//TODO something or no-op
+// clauses are the directives that apply to the step declared before them
+var clauses = map[string]bool{
+	directiveName:    true,
+	directiveInputs:  true,
+	directiveOutputs: true,
+	directiveAfter:   true,
+	directiveTimeout: true,
+	directiveRetry:   true,
+	directiveCache:   true,
+}
+
+// bare are the directives that do not accept any arguments
+var bare = map[string]bool{
+	directiveFinally: true,
+	directiveEnd:     true,
+}
+
+// Options customize how a spec is interpreted
+type Options struct {
+	// BuildArgs override the default values of ARG directives
+	BuildArgs map[string]string
+	// ReadFile reads the files named by INCLUDE directives, which are
+	// read from disk with ioutil.ReadFile by default
+	ReadFile func(path string) ([]byte, error)
+	// LookupEnv looks up the variables of the environment that snb is
+	// invoked in, which are interpolated when not declared with ENV or
+	// ARG. It is os.LookupEnv by default.
+	LookupEnv func(key string) (string, bool)
+	// Glob returns the paths matching the patterns of FOREACH
+	// directives, which are matched with filepath.Glob by default
+	Glob func(pattern string) ([]string, error)
+}
+
+// Parse converts the contents of a spec file into a Spec. The file name
+// annotates the positions of any errors reported, and is what the paths
+// of included files are relative to.
+func Parse(file string, specFile []byte, opts Options) (Spec, error) {
+	ast, err := ParseAST(file, specFile)
+	if err != nil {
+		return Spec{}, err
 	}
 
-	var spec Spec
-	for _, match := range matches {
-		spec.Steps = append(spec.Steps, strings.TrimSpace(match[1]))
+	b := newBuilder(file, opts)
+	for _, node := range ast.Nodes {
+		if err := b.apply(node); err != nil {
+			return Spec{}, err
+		}
+	}
+
+	if len(b.spec.Steps) == 0 {
+		return Spec{}, errorf(Position{File: file, Line: 1, Column: 1}, "no %s directives found", directiveRun)
+	}
+
+	if err := b.finish(); err != nil {
+		return Spec{}, err
+	}
+
+	return b.spec, nil
+}
+
+// ParseAST converts the contents of a spec file into its syntax tree
+// without interpreting any of the directives
+func ParseAST(file string, specFile []byte) (*AST, error) {
+	tokens, err := lex(file, specFile)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &astParser{tokens: tokens}
+
+	ast := &AST{File: file}
+	for {
+		node, err := p.parseNode(ast)
+		if err != nil {
+			return nil, err
+		}
+
+		if node == nil {
+			return ast, nil
+		}
+
+		if node.Directive == directiveEnd {
+			return nil, errorf(node.Pos, "%s does not close a block", directiveEnd)
+		}
+
+		ast.Nodes = append(ast.Nodes, node)
+	}
+}
+
+type astParser struct {
+	tokens []token
+	index  int
+	// previous is the node parsed last
+	previous *Node
+}
+
+func (p *astParser) next() token {
+	tok := p.tokens[p.index]
+	if tok.typ != tokenEOF {
+		p.index++
+	}
+	return tok
+}
+
+func (p *astParser) peek() token {
+	return p.tokens[p.index]
+}
+
+// parseNode returns the next directive in the token stream, or nil
+// once the end of the file has been reached. Comments preceding the
+// directive or within its continued lines are attached to it, and the
+// ones at the end of the file are attached to the syntax tree.
+func (p *astParser) parseNode(ast *AST) (*Node, error) {
+	var comments []string
+
+	for {
+		switch p.peek().typ {
+		case tokenBlank:
+			p.next()
+			continue
+		case tokenComment:
+			comments = append(comments, p.next().value)
+			continue
+		}
+		break
 	}
 
-	return spec, nil
-}
\ No newline at end of file
+	word := p.next()
+	switch word.typ {
+	case tokenEOF:
+		ast.Comments = comments
+		return nil, nil
+	case tokenWord:
+	default:
+		return nil, errorf(word.pos, "unexpected %q", word.value)
+	}
+
+	directive := strings.ToUpper(word.value)
+	if !directives[directive] {
+		if p.continuesStep(word) {
+			return nil, errorf(word.pos, "unknown directive %q; end the line before it with \\ to continue the command of its step", word.value)
+		}
+
+		return nil, errorf(word.pos, "unknown directive %q", word.value)
+	}
+
+	text := p.readText()
+	node := &Node{
+		Directive: directive,
+		Args:      strings.TrimSpace(text.value),
+		Pos:       word.pos,
+		Comments:  append(comments, text.comments...),
+	}
+
+	if p.peek().typ == tokenHeredoc {
+		if directive != directiveRun {
+			return nil, errorf(word.pos, "%s does not accept a heredoc", directive)
+		}
+
+		heredoc := p.next()
+		node.Heredoc = true
+		node.Body, node.Raw = heredoc.value, heredoc.raw
+	}
+
+	if p.peek().typ == tokenNewline {
+		p.next()
+	}
+
+	if bare[directive] && node.Args != "" {
+		return nil, errorf(node.Pos, "%s does not accept arguments", directive)
+	}
+
+	p.previous = node
+
+	if blocks[directive] {
+		if err := p.parseBlock(node, ast); err != nil {
+			return nil, err
+		}
+	}
+
+	return node, nil
+}
+
+// continuesStep reports whether a word that is not a directive is
+// indented right below a RUN line, as commands were once continued
+// without a backslash
+func (p *astParser) continuesStep(word token) bool {
+	previous := p.previous
+	if previous == nil || previous.Directive != directiveRun || previous.Heredoc {
+		return false
+	}
+
+	// the word was just consumed, so the token before it ended the
+	// previous line unless blank lines or comments were skipped
+	return p.tokens[p.index-2].typ == tokenNewline && word.pos.Column > previous.Pos.Column
+}
+
+// parseBlock collects the nodes following a block directive into it, up
+// to the END directive closing it
+func (p *astParser) parseBlock(block *Node, ast *AST) error {
+	for {
+		node, err := p.parseNode(ast)
+		if err != nil {
+			return err
+		}
+
+		if node == nil {
+			return errorf(block.Pos, "%s is not closed by %s", block.Directive, directiveEnd)
+		}
+
+		if node.Directive == directiveEnd {
+			block.End = node
+			return nil
+		}
+
+		block.Nodes = append(block.Nodes, node)
+	}
+}
+
+// readText consumes the text following the word of the current line
+func (p *astParser) readText() token {
+	if p.peek().typ == tokenText {
+		return p.next()
+	}
+
+	return token{typ: tokenText}
+}
@@ -3,6 +3,10 @@ package parser_test
 import (
 	. "github.com/aemengo/snb/parser"
 
+	"errors"
+	"regexp"
+	"time"
+
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 )
@@ -22,14 +26,14 @@ var _ = Describe("Parser", func() {
 			})
 
 			It("returns multiple steps", func() {
-				spec, err := Parse(specContents)
+				spec, err := Parse("ShakeAndBakeFile", specContents, Options{})
 				Expect(err).NotTo(HaveOccurred())
 
 				Expect(spec).To(Equal(Spec{
-					Steps: []string{
-						"./some-command 1",
-						"./some-command 2",
-						"./some-command 3",
+					Steps: []Step{
+						{Command: "./some-command 1", Pos: Position{File: "ShakeAndBakeFile", Line: 2, Column: 5}},
+						{Command: "./some-command 2", Pos: Position{File: "ShakeAndBakeFile", Line: 4, Column: 5}},
+						{Command: "./some-command 3", Pos: Position{File: "ShakeAndBakeFile", Line: 6, Column: 5}},
 					},
 				}))
 
@@ -50,24 +54,1581 @@ var _ = Describe("Parser", func() {
 			})
 
 			It("returns multiple steps", func() {
-				spec, err := Parse(specContents)
+				spec, err := Parse("ShakeAndBakeFile", specContents, Options{})
 				Expect(err).NotTo(HaveOccurred())
 
 				Expect(len(spec.Steps)).To(Equal(3))
 
-				Expect(spec.Steps[0]).To(SatisfyAll(
+				Expect(spec.Steps[0].Command).To(SatisfyAll(
 					ContainSubstring(`./some-command 1 && \`),
 					ContainSubstring(`./some-added-command 1`),
 				))
-				Expect(spec.Steps[1]).To(SatisfyAll(
+				Expect(spec.Steps[1].Command).To(SatisfyAll(
 					ContainSubstring(`./some-command 2 && \`),
 					ContainSubstring(`./some-added-command 2`),
 				))
-				Expect(spec.Steps[2]).To(SatisfyAll(
+				Expect(spec.Steps[2].Command).To(SatisfyAll(
 					ContainSubstring(`./some-command 3 && \`),
 					ContainSubstring(`./some-added-command 3`),
 				))
 			})
 		})
+
+		Context("when a directive is written in lowercase", func() {
+			BeforeEach(func() {
+				specContents = []byte(`run ./some-command 1`)
+			})
+
+			It("returns the step", func() {
+				spec, err := Parse("ShakeAndBakeFile", specContents, Options{})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(len(spec.Steps)).To(Equal(1))
+				Expect(spec.Steps[0].Command).To(Equal("./some-command 1"))
+			})
+		})
+
+		Context("when a step declares its inputs and outputs", func() {
+			BeforeEach(func() {
+				specContents = []byte(`
+RUN ./some-command 1
+INPUTS ./some-input *.go
+INPUTS ./some-other-input
+OUTPUTS ./some-output
+
+RUN ./some-command 2`)
+			})
+
+			It("attaches them to the step", func() {
+				spec, err := Parse("ShakeAndBakeFile", specContents, Options{})
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(len(spec.Steps)).To(Equal(2))
+				Expect(spec.Steps[0].Command).To(Equal("./some-command 1"))
+				Expect(spec.Steps[0].Inputs).To(Equal([]string{"./some-input", "*.go", "./some-other-input"}))
+				Expect(spec.Steps[0].Outputs).To(Equal([]string{"./some-output"}))
+				Expect(spec.Steps[1].Inputs).To(BeEmpty())
+				Expect(spec.Steps[1].Outputs).To(BeEmpty())
+			})
+		})
+
+		Context("when inputs are declared before any step", func() {
+			BeforeEach(func() {
+				specContents = []byte(`INPUTS ./some-input
+
+RUN ./some-command 1`)
+			})
+
+			It("returns an error", func() {
+				_, err := Parse("ShakeAndBakeFile", specContents, Options{})
+				Expect(err).To(MatchError(`ShakeAndBakeFile:1:1: INPUTS must follow a RUN directive`))
+			})
+		})
+
+		Context("when steps are named", func() {
+			BeforeEach(func() {
+				specContents = []byte(`
+RUN ./some-command 1
+NAME some-step
+
+RUN ./some-command 2`)
+			})
+
+			It("attaches the name to the step", func() {
+				spec, err := Parse("ShakeAndBakeFile", specContents, Options{})
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(spec.Steps[0].Name).To(Equal("some-step"))
+				Expect(spec.Steps[0].String()).To(Equal("some-step"))
+				Expect(spec.Steps[1].Name).To(BeEmpty())
+				Expect(spec.Steps[1].String()).To(Equal("./some-command 2"))
+
+				index, err := spec.Lookup("some-step")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(index).To(Equal(0))
+
+				_, err = spec.Lookup("some-non-existent-step")
+				Expect(err).To(MatchError(`no step named "some-non-existent-step"`))
+			})
+		})
+
+		Context("when a step name is declared twice", func() {
+			BeforeEach(func() {
+				specContents = []byte(`RUN ./some-command 1
+NAME some-step
+
+RUN ./some-command 2
+NAME some-step`)
+			})
+
+			It("returns an error", func() {
+				_, err := Parse("ShakeAndBakeFile", specContents, Options{})
+				Expect(err).To(MatchError(`ShakeAndBakeFile:5:1: step name "some-step" is already declared at ShakeAndBakeFile:2:1`))
+			})
+		})
+
+		Context("when a step name is invalid", func() {
+			BeforeEach(func() {
+				specContents = []byte(`RUN ./some-command 1
+NAME some step`)
+			})
+
+			It("returns an error", func() {
+				_, err := Parse("ShakeAndBakeFile", specContents, Options{})
+				Expect(err).To(MatchError(`ShakeAndBakeFile:2:1: invalid step name "some step"`))
+			})
+		})
+
+		Context("when a step is inserted before others", func() {
+			It("keeps the identity of the existing steps", func() {
+				before, err := Parse("ShakeAndBakeFile", []byte("RUN ./some-command 1\n\nRUN ./some-command 2"), Options{})
+				Expect(err).NotTo(HaveOccurred())
+
+				after, err := Parse("ShakeAndBakeFile", []byte("RUN ./some-command 0\n\nRUN ./some-command 1\n\nRUN ./some-command 2"), Options{})
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(after.Steps[1].ID()).To(Equal(before.Steps[0].ID()))
+				Expect(after.Steps[2].ID()).To(Equal(before.Steps[1].ID()))
+			})
+
+			It("distinguishes steps with the same command", func() {
+				spec, err := Parse("ShakeAndBakeFile", []byte("RUN ./some-command 1\n\nRUN ./some-command 1"), Options{})
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(spec.Steps[0].ID()).NotTo(Equal(spec.Steps[1].ID()))
+			})
+		})
+
+		Context("when a continued step is reindented", func() {
+			It("keeps the identity of the step", func() {
+				before, err := Parse("ShakeAndBakeFile", []byte("RUN ./some-command \\\n  --flag"), Options{})
+				Expect(err).NotTo(HaveOccurred())
+
+				after, err := Parse("ShakeAndBakeFile", []byte("RUN ./some-command\t\\\n        --flag"), Options{})
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(after.Steps[0].Command).NotTo(Equal(before.Steps[0].Command))
+				Expect(after.Steps[0].ID()).To(Equal(before.Steps[0].ID()))
+				Expect(after.Steps[0].Definition()).NotTo(Equal(before.Steps[0].Definition()))
+			})
+
+			It("distinguishes a continuation joining a word", func() {
+				spaced, err := Parse("ShakeAndBakeFile", []byte("RUN ./some-command \\\n--flag"), Options{})
+				Expect(err).NotTo(HaveOccurred())
+
+				joined, err := Parse("ShakeAndBakeFile", []byte("RUN ./some-command\\\n--flag"), Options{})
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(joined.Steps[0].ID()).NotTo(Equal(spaced.Steps[0].ID()))
+			})
+
+			It("distinguishes steps with the same command otherwise", func() {
+				spec, err := Parse("ShakeAndBakeFile", []byte("RUN ./some-command \\\n  1\n\nRUN ./some-command \\\n    1"), Options{})
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(spec.Steps[0].ID()).NotTo(Equal(spec.Steps[1].ID()))
+			})
+		})
+
+		Context("when steps declare their dependencies", func() {
+			BeforeEach(func() {
+				specContents = []byte(`
+RUN ./some-command 1
+NAME first
+
+RUN ./some-command 2
+NAME second
+AFTER first third
+
+RUN ./some-command 3
+NAME third
+AFTER first
+
+RUN ./some-command 4
+NAME fourth`)
+			})
+
+			It("orders the steps by their dependencies", func() {
+				spec, err := Parse("ShakeAndBakeFile", specContents, Options{})
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(spec.Steps[1].After).To(Equal([]string{"first", "third"}))
+				Expect(spec.Order()).To(Equal([]int{0, 2, 1, 3}))
+				Expect(spec.Needs(1)).To(Equal([]int{0, 2}))
+				Expect(spec.Dependencies(1)).To(Equal([]int{0, 2}))
+				Expect(spec.Dependencies(0)).To(BeEmpty())
+			})
+
+			It("depends the steps without dependencies on the one before them", func() {
+				spec, err := Parse("ShakeAndBakeFile", specContents, Options{})
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(spec.Needs(3)).To(Equal([]int{2}))
+				Expect(spec.Dependencies(3)).To(Equal([]int{0, 2}))
+			})
+		})
+
+		Context("when no steps declare their dependencies", func() {
+			BeforeEach(func() {
+				specContents = []byte("RUN ./some-command 1\n\nRUN ./some-command 2\n\nRUN ./some-command 3")
+			})
+
+			It("depends every step on the one before it", func() {
+				spec, err := Parse("ShakeAndBakeFile", specContents, Options{})
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(spec.Order()).To(Equal([]int{0, 1, 2}))
+				Expect(spec.Needs(0)).To(BeEmpty())
+				Expect(spec.Needs(2)).To(Equal([]int{1}))
+				Expect(spec.Dependencies(2)).To(Equal([]int{0, 1}))
+			})
+		})
+
+		Context("when a step depends on an unknown step", func() {
+			BeforeEach(func() {
+				specContents = []byte(`RUN ./some-command 1
+AFTER some-step`)
+			})
+
+			It("returns an error", func() {
+				_, err := Parse("ShakeAndBakeFile", specContents, Options{})
+				Expect(err).To(MatchError(`ShakeAndBakeFile:2:1: no step named "some-step"`))
+			})
+		})
+
+		Context("when the dependencies of steps form a cycle", func() {
+			BeforeEach(func() {
+				specContents = []byte(`RUN ./some-command 1
+NAME first
+AFTER third
+
+RUN ./some-command 2
+NAME second
+AFTER first
+
+RUN ./some-command 3
+NAME third
+AFTER second`)
+			})
+
+			It("returns an error describing the cycle", func() {
+				_, err := Parse("ShakeAndBakeFile", specContents, Options{})
+				Expect(err).To(MatchError(`ShakeAndBakeFile:3:1: dependency cycle: first -> third -> second -> first`))
+			})
+		})
+
+		Context("when variables are declared", func() {
+			BeforeEach(func() {
+				specContents = []byte(`
+RUN ./some-command 1
+
+ENV GREETING="hello world" TARGET=linux
+ARG VERSION=1.0 CHANNEL
+
+RUN ./some-command 2
+
+ENV TARGET=darwin
+
+RUN ./some-command 3`)
+			})
+
+			It("declares them for the steps that follow", func() {
+				spec, err := Parse("ShakeAndBakeFile", specContents, Options{})
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(spec.Steps[0].Env).To(BeEmpty())
+				Expect(spec.Steps[1].Env).To(Equal([]string{"GREETING=hello world", "TARGET=linux", "VERSION=1.0"}))
+				Expect(spec.Steps[2].Env).To(Equal([]string{"GREETING=hello world", "VERSION=1.0", "TARGET=darwin"}))
+				Expect(spec.Steps[2].Definition()).To(ContainSubstring("ENV TARGET=darwin"))
+			})
+
+			It("overrides arguments with build arguments", func() {
+				spec, err := Parse("ShakeAndBakeFile", specContents, Options{
+					BuildArgs: map[string]string{"VERSION": "2.0", "CHANNEL": "beta"},
+				})
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(spec.Steps[1].Env).To(Equal([]string{"GREETING=hello world", "TARGET=linux", "VERSION=2.0", "CHANNEL=beta"}))
+			})
+
+			It("returns an error for undeclared build arguments", func() {
+				_, err := Parse("ShakeAndBakeFile", specContents, Options{
+					BuildArgs: map[string]string{"VERSON": "2.0"},
+				})
+				Expect(err).To(MatchError("build arguments were not declared with ARG: VERSON"))
+			})
+
+			It("leaves arguments without a value to the environment", func() {
+				spec, err := Parse("ShakeAndBakeFile", []byte("ARG HOME\n\nRUN echo ${HOME}"), Options{
+					LookupEnv: func(key string) (string, bool) {
+						return "/home/someone", key == "HOME"
+					},
+				})
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(spec.Steps[0].Env).To(BeEmpty())
+				Expect(spec.Steps[0].Command).To(Equal("echo /home/someone"))
+			})
+		})
+
+		Context("when an environment variable has no value", func() {
+			BeforeEach(func() {
+				specContents = []byte(`ENV GREETING
+
+RUN ./some-command 1`)
+			})
+
+			It("returns an error", func() {
+				_, err := Parse("ShakeAndBakeFile", specContents, Options{})
+				Expect(err).To(MatchError("ShakeAndBakeFile:1:1: ENV requires KEY=value pairs"))
+			})
+		})
+
+		Context("when working directories are declared", func() {
+			BeforeEach(func() {
+				specContents = []byte(`
+RUN ./some-command 1
+
+WORKDIR frontend
+RUN ./some-command 2
+
+WORKDIR app
+RUN ./some-command 3
+
+WORKDIR /tmp
+RUN ./some-command 4`)
+			})
+
+			It("resolves them relative to the one declared before", func() {
+				spec, err := Parse("ShakeAndBakeFile", specContents, Options{})
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(spec.Steps[0].WorkDir).To(BeEmpty())
+				Expect(spec.Steps[1].WorkDir).To(Equal("frontend"))
+				Expect(spec.Steps[2].WorkDir).To(Equal("frontend/app"))
+				Expect(spec.Steps[3].WorkDir).To(Equal("/tmp"))
+			})
+		})
+
+		Context("when other spec files are included", func() {
+			var files map[string]string
+
+			BeforeEach(func() {
+				files = map[string]string{
+					"shared/lint.snb":    "RUN ./lint.sh\nNAME lint\n\nINCLUDE license.snb",
+					"shared/license.snb": "RUN ./check-license.sh",
+				}
+
+				specContents = []byte(`
+INCLUDE shared/lint.snb
+
+RUN ./some-command 1`)
+			})
+
+			readFile := func(path string) ([]byte, error) {
+				contents, ok := files[path]
+				if !ok {
+					return nil, errors.New("no such file")
+				}
+				return []byte(contents), nil
+			}
+
+			It("declares their steps relative to the including file", func() {
+				spec, err := Parse("ShakeAndBakeFile", specContents, Options{ReadFile: readFile})
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(len(spec.Steps)).To(Equal(3))
+				Expect(spec.Steps[0].Name).To(Equal("lint"))
+				Expect(spec.Steps[0].Pos).To(Equal(Position{File: "shared/lint.snb", Line: 1, Column: 1}))
+				Expect(spec.Steps[0].Source).NotTo(BeEmpty())
+				Expect(spec.Steps[1].Command).To(Equal("./check-license.sh"))
+				Expect(spec.Steps[1].Pos.File).To(Equal("shared/license.snb"))
+				Expect(spec.Steps[2].Command).To(Equal("./some-command 1"))
+				Expect(spec.Steps[2].Source).To(BeEmpty())
+			})
+
+			It("changes the definition of their steps when they change", func() {
+				before, err := Parse("ShakeAndBakeFile", specContents, Options{ReadFile: readFile})
+				Expect(err).NotTo(HaveOccurred())
+
+				files["shared/lint.snb"] += "\n\nRUN ./some-other-command"
+
+				after, err := Parse("ShakeAndBakeFile", specContents, Options{ReadFile: readFile})
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(after.Steps[0].Definition()).NotTo(Equal(before.Steps[0].Definition()))
+				Expect(after.Steps[1].Definition()).To(Equal(before.Steps[1].Definition()))
+			})
+
+			It("reports errors at their position in the included file", func() {
+				files["shared/license.snb"] = "RUN ./check-license.sh\n\nRUNN ./oops"
+
+				_, err := Parse("ShakeAndBakeFile", specContents, Options{ReadFile: readFile})
+				Expect(err).To(MatchError(`shared/license.snb:3:1: unknown directive "RUNN"`))
+			})
+
+			It("returns an error for a missing file", func() {
+				_, err := Parse("ShakeAndBakeFile", []byte("INCLUDE missing.snb"), Options{ReadFile: readFile})
+				Expect(err).To(MatchError("ShakeAndBakeFile:1:1: cannot include missing.snb: no such file"))
+			})
+
+			It("returns an error when the includes form a cycle", func() {
+				files["shared/license.snb"] = "INCLUDE lint.snb"
+
+				_, err := Parse("ShakeAndBakeFile", specContents, Options{ReadFile: readFile})
+				Expect(err).To(MatchError("shared/license.snb:1:1: include cycle: shared/lint.snb -> shared/license.snb -> shared/lint.snb"))
+			})
+		})
+
+		Context("when the spec contains comments", func() {
+			BeforeEach(func() {
+				specContents = []byte(`# build the project
+RUN ./some-command 1 && \
+    # explain the next line
+    ./some-added-command 1
+
+  # RUN ./some-disabled-command
+RUN ./some-command 2`)
+			})
+
+			It("strips them from the steps", func() {
+				spec, err := Parse("ShakeAndBakeFile", specContents, Options{})
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(len(spec.Steps)).To(Equal(2))
+				Expect(spec.Steps[0].Command).To(Equal("./some-command 1 && \\\n    ./some-added-command 1"))
+				Expect(spec.Steps[1].Command).To(Equal("./some-command 2"))
+				Expect(spec.Steps[1].Pos.Line).To(Equal(7))
+			})
+
+			It("keeps them in the syntax tree", func() {
+				ast, err := ParseAST("ShakeAndBakeFile", append(specContents, []byte("\n# the end")...))
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(ast.Nodes[0].Comments).To(Equal([]string{"# build the project", "# explain the next line"}))
+				Expect(ast.Nodes[1].Comments).To(Equal([]string{"# RUN ./some-disabled-command"}))
+				Expect(ast.Comments).To(Equal([]string{"# the end"}))
+			})
+		})
+
+		Context("when a continued command spans blank lines", func() {
+			BeforeEach(func() {
+				specContents = []byte(`RUN ./some-command 1 && \
+
+    ./some-added-command 1
+NAME first`)
+			})
+
+			It("does not end the step", func() {
+				spec, err := Parse("ShakeAndBakeFile", specContents, Options{})
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(len(spec.Steps)).To(Equal(1))
+				Expect(spec.Steps[0].Name).To(Equal("first"))
+				Expect(spec.Steps[0].Command).To(Equal("./some-command 1 && \\\n    ./some-added-command 1"))
+			})
+		})
+
+		Context("when a command is continued without a backslash", func() {
+			BeforeEach(func() {
+				specContents = []byte(`RUN ./some-command 1 &&
+    ./some-added-command 1`)
+			})
+
+			It("returns an error with the position of the next line", func() {
+				_, err := Parse("ShakeAndBakeFile", specContents, Options{})
+				Expect(err).To(MatchError(`ShakeAndBakeFile:2:5: unknown directive "./some-added-command"; end the line before it with \ to continue the command of its step`))
+			})
+
+			It("does not suggest a continuation when the line is not indented", func() {
+				_, err := Parse("ShakeAndBakeFile", []byte("RUN ./some-command 1 &&\n./some-added-command 1"), Options{})
+				Expect(err).To(MatchError(`ShakeAndBakeFile:2:1: unknown directive "./some-added-command"`))
+			})
+
+			It("does not suggest a continuation after a blank line", func() {
+				_, err := Parse("ShakeAndBakeFile", []byte("RUN ./some-command 1\n\n    ./some-added-command 1"), Options{})
+				Expect(err).To(MatchError(`ShakeAndBakeFile:3:5: unknown directive "./some-added-command"`))
+			})
+		})
+
+		Context("when a step is declared with a heredoc", func() {
+			BeforeEach(func() {
+				specContents = []byte(`RUN <<EOF
+for i in 1 2; do
+
+  echo "# $i"
+done
+EOF
+NAME loop
+
+RUN <<-"SCRIPT"
+	./some-command
+	SCRIPT`)
+			})
+
+			It("uses the body as the command with its blank lines and indentation", func() {
+				spec, err := Parse("ShakeAndBakeFile", specContents, Options{})
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(len(spec.Steps)).To(Equal(2))
+				Expect(spec.Steps[0].Name).To(Equal("loop"))
+				Expect(spec.Steps[0].Command).To(Equal("for i in 1 2; do\n\n  echo \"# $i\"\ndone"))
+				Expect(spec.Steps[0].Definition()).To(HavePrefix(spec.Steps[0].Command))
+				Expect(spec.Steps[1].Command).To(Equal("./some-command"))
+				Expect(spec.Steps[1].Pos.Line).To(Equal(9))
+			})
+		})
+
+		Context("when a heredoc is not terminated", func() {
+			BeforeEach(func() {
+				specContents = []byte(`RUN <<EOF
+./some-command
+EOF_`)
+			})
+
+			It("returns an error", func() {
+				_, err := Parse("ShakeAndBakeFile", specContents, Options{})
+				Expect(err).To(MatchError(`ShakeAndBakeFile:1:4: heredoc is not terminated by EOF`))
+			})
+		})
+
+		Context("when a heredoc follows a directive other than RUN", func() {
+			BeforeEach(func() {
+				specContents = []byte(`RUN ./some-command
+INPUTS <<EOF
+some-file
+EOF`)
+			})
+
+			It("returns an error", func() {
+				_, err := Parse("ShakeAndBakeFile", specContents, Options{})
+				Expect(err).To(MatchError(`ShakeAndBakeFile:2:1: INPUTS does not accept a heredoc`))
+			})
+		})
+
+		Context("when a heredoc is empty", func() {
+			BeforeEach(func() {
+				specContents = []byte("RUN <<EOF\n\nEOF")
+			})
+
+			It("returns an error", func() {
+				_, err := Parse("ShakeAndBakeFile", specContents, Options{})
+				Expect(err).To(MatchError(`ShakeAndBakeFile:1:1: RUN requires a command`))
+			})
+		})
+
+		Context("when shells are declared", func() {
+			BeforeEach(func() {
+				specContents = []byte(`RUN ./some-command 1
+
+SHELL ["sh", "-eu", "-c"]
+RUN ./some-command 2
+
+shell ["python3", "-c"]
+RUN print("some-command 3")`)
+			})
+
+			It("executes every step that follows with the shell", func() {
+				spec, err := Parse("ShakeAndBakeFile", specContents, Options{})
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(spec.Steps[0].Shell).To(BeEmpty())
+				Expect(spec.Steps[0].Args()).To(Equal([]string{"bash", "-c", "./some-command 1"}))
+				Expect(spec.Steps[1].Args()).To(Equal([]string{"sh", "-eu", "-c", "./some-command 2"}))
+				Expect(spec.Steps[2].Args()).To(Equal([]string{"python3", "-c", `print("some-command 3")`}))
+			})
+
+			It("includes the shell in the definition of the steps", func() {
+				spec, err := Parse("ShakeAndBakeFile", specContents, Options{})
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(spec.Steps[0].Definition()).To(Equal("./some-command 1"))
+				Expect(spec.Steps[1].Definition()).To(Equal("./some-command 2\n" + `SHELL ["sh","-eu","-c"]`))
+			})
+		})
+
+		Context("when a shell is not a JSON array", func() {
+			BeforeEach(func() {
+				specContents = []byte(`SHELL sh -c
+RUN ./some-command`)
+			})
+
+			It("returns an error", func() {
+				_, err := Parse("ShakeAndBakeFile", specContents, Options{})
+				Expect(err).To(MatchError(`ShakeAndBakeFile:1:1: SHELL requires a JSON array of strings, such as ["sh", "-c"]`))
+			})
+		})
+
+		Context("when a shell is empty", func() {
+			BeforeEach(func() {
+				specContents = []byte(`SHELL []
+RUN ./some-command`)
+			})
+
+			It("returns an error", func() {
+				_, err := Parse("ShakeAndBakeFile", specContents, Options{})
+				Expect(err).To(MatchError(`ShakeAndBakeFile:1:1: SHELL requires a JSON array of strings, such as ["sh", "-c"]`))
+			})
+		})
+
+		Context("when variables are interpolated", func() {
+			var opts Options
+
+			BeforeEach(func() {
+				opts = Options{
+					LookupEnv: func(key string) (string, bool) {
+						if key == "SOME_PROCESS_VAR" {
+							return "some-process-value", true
+						}
+						return "", false
+					},
+				}
+
+				specContents = []byte(`ARG OUT_DIR=build
+ENV TARGET=${OUT_DIR}/bin EMPTY=
+WORKDIR ${SOME_PROCESS_VAR}
+RUN ./build.sh ${OUT_DIR} ${TARGET} ${SOME_PROCESS_VAR}
+NAME build-${OUT_DIR}
+INPUTS ${OUT_DIR}/src
+OUTPUTS ${TARGET}
+
+RUN ./deploy.sh ${UNKNOWN:-some-default} ${EMPTY:-some-default} ${EMPTY} ${UNKNOWN} \${OUT_DIR} $OUT_DIR`)
+			})
+
+			It("expands them from the declared variables and the environment", func() {
+				spec, err := Parse("ShakeAndBakeFile", specContents, opts)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(spec.Steps[0].Command).To(Equal("./build.sh build build/bin some-process-value"))
+				Expect(spec.Steps[0].Name).To(Equal("build-build"))
+				Expect(spec.Steps[0].Inputs).To(Equal([]string{"build/src"}))
+				Expect(spec.Steps[0].Outputs).To(Equal([]string{"build/bin"}))
+				Expect(spec.Steps[0].WorkDir).To(Equal("some-process-value"))
+				Expect(spec.Steps[0].Env).To(ContainElement("TARGET=build/bin"))
+			})
+
+			It("leaves unknown and escaped references to the shell", func() {
+				spec, err := Parse("ShakeAndBakeFile", specContents, opts)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(spec.Steps[1].Command).To(Equal("./deploy.sh some-default some-default  ${UNKNOWN} ${OUT_DIR} $OUT_DIR"))
+			})
+
+			It("expands build arguments", func() {
+				opts.BuildArgs = map[string]string{"OUT_DIR": "dist"}
+
+				spec, err := Parse("ShakeAndBakeFile", specContents, opts)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(spec.Steps[0].Command).To(Equal("./build.sh dist dist/bin some-process-value"))
+			})
+		})
+
+		Context("when steps are expanded for a list of items", func() {
+			BeforeEach(func() {
+				specContents = []byte(`FOREACH os IN linux darwin
+  FOREACH arch IN amd64 arm64
+    RUN GOOS=${os} GOARCH=${arch} go build -o bin/${os}/${arch}/app
+    NAME build-${os}
+  END
+END
+
+RUN ./package.sh`)
+			})
+
+			It("declares a distinctly named step for every item", func() {
+				spec, err := Parse("ShakeAndBakeFile", specContents, Options{})
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(len(spec.Steps)).To(Equal(5))
+				Expect(spec.Steps[0].Name).To(Equal("build-linux-amd64"))
+				Expect(spec.Steps[0].Command).To(Equal("GOOS=linux GOARCH=amd64 go build -o bin/linux/amd64/app"))
+				Expect(spec.Steps[1].Name).To(Equal("build-linux-arm64"))
+				Expect(spec.Steps[2].Name).To(Equal("build-darwin-amd64"))
+				Expect(spec.Steps[3].Name).To(Equal("build-darwin-arm64"))
+				Expect(spec.Steps[3].Command).To(Equal("GOOS=darwin GOARCH=arm64 go build -o bin/darwin/arm64/app"))
+				Expect(spec.Steps[4].Command).To(Equal("./package.sh"))
+			})
+
+			It("keeps the expanded steps in the syntax tree", func() {
+				ast, err := ParseAST("ShakeAndBakeFile", specContents)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(len(ast.Nodes)).To(Equal(2))
+				Expect(ast.Nodes[0].Nodes[0].Directive).To(Equal("FOREACH"))
+				Expect(len(ast.Nodes[0].Nodes[0].Nodes)).To(Equal(2))
+				Expect(ast.Nodes[0].End.Pos.Line).To(Equal(6))
+			})
+		})
+
+		Context("when steps are expanded for the paths matching a pattern", func() {
+			var patterns []string
+
+			BeforeEach(func() {
+				patterns = nil
+				specContents = []byte(`WORKDIR some-dir
+FOREACH dir IN services/* extra
+  RUN make -C ${dir}
+END`)
+			})
+
+			It("declares a step for every path, relative to the working directory", func() {
+				spec, err := Parse("ShakeAndBakeFile", specContents, Options{
+					Glob: func(pattern string) ([]string, error) {
+						patterns = append(patterns, pattern)
+						return []string{"some-dir/services/api", "some-dir/services/web"}, nil
+					},
+				})
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(patterns).To(Equal([]string{"some-dir/services/*"}))
+				Expect(len(spec.Steps)).To(Equal(3))
+				Expect(spec.Steps[0].Command).To(Equal("make -C services/api"))
+				Expect(spec.Steps[1].Command).To(Equal("make -C services/web"))
+				Expect(spec.Steps[2].Command).To(Equal("make -C extra"))
+			})
+
+			It("returns an error when no paths match", func() {
+				_, err := Parse("ShakeAndBakeFile", specContents, Options{
+					Glob: func(pattern string) ([]string, error) {
+						return nil, nil
+					},
+				})
+				Expect(err).To(MatchError(`ShakeAndBakeFile:2:1: pattern "services/*" does not match any paths`))
+			})
+		})
+
+		Context("when a FOREACH is not closed", func() {
+			BeforeEach(func() {
+				specContents = []byte(`FOREACH os IN linux darwin
+RUN ./some-command ${os}`)
+			})
+
+			It("returns an error", func() {
+				_, err := Parse("ShakeAndBakeFile", specContents, Options{})
+				Expect(err).To(MatchError(`ShakeAndBakeFile:1:1: FOREACH is not closed by END`))
+			})
+		})
+
+		Context("when an END does not close a block", func() {
+			BeforeEach(func() {
+				specContents = []byte(`RUN ./some-command
+END`)
+			})
+
+			It("returns an error", func() {
+				_, err := Parse("ShakeAndBakeFile", specContents, Options{})
+				Expect(err).To(MatchError(`ShakeAndBakeFile:2:1: END does not close a block`))
+			})
+		})
+
+		Context("when a FOREACH has no items", func() {
+			BeforeEach(func() {
+				specContents = []byte(`FOREACH os
+RUN ./some-command ${os}
+END`)
+			})
+
+			It("returns an error", func() {
+				_, err := Parse("ShakeAndBakeFile", specContents, Options{})
+				Expect(err).To(MatchError(`ShakeAndBakeFile:1:1: FOREACH requires a variable, IN and at least one item`))
+			})
+		})
+
+		Context("when a clause follows an END", func() {
+			BeforeEach(func() {
+				specContents = []byte(`FOREACH os IN linux darwin
+RUN ./some-command ${os}
+END
+NAME some-name`)
+			})
+
+			It("returns an error", func() {
+				_, err := Parse("ShakeAndBakeFile", specContents, Options{})
+				Expect(err).To(MatchError(`ShakeAndBakeFile:4:1: NAME must follow a RUN directive`))
+			})
+		})
+
+		Context("when a step declares a timeout", func() {
+			BeforeEach(func() {
+				specContents = []byte(`RUN ./some-command 1
+TIMEOUT 10m
+
+RUN ./some-command 2`)
+			})
+
+			It("returns the timeout of the step", func() {
+				spec, err := Parse("ShakeAndBakeFile", specContents, Options{})
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(spec.Steps[0].Timeout).To(Equal(10 * time.Minute))
+				Expect(spec.Steps[1].Timeout).To(BeZero())
+			})
+		})
+
+		Context("when a timeout is invalid", func() {
+			BeforeEach(func() {
+				specContents = []byte(`RUN ./some-command
+TIMEOUT ten`)
+			})
+
+			It("returns an error", func() {
+				_, err := Parse("ShakeAndBakeFile", specContents, Options{})
+				Expect(err).To(MatchError(`ShakeAndBakeFile:2:1: invalid timeout "ten"`))
+			})
+		})
+
+		Context("when steps declare retries", func() {
+			BeforeEach(func() {
+				specContents = []byte(`RUN ./some-command 1
+RETRY 3
+
+RUN ./some-command 2
+RETRY 5 10s
+
+RUN ./some-command 3`)
+			})
+
+			It("returns the attempts and backoff of the steps", func() {
+				spec, err := Parse("ShakeAndBakeFile", specContents, Options{})
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(spec.Steps[0].Attempts).To(Equal(3))
+				Expect(spec.Steps[0].Backoff).To(BeZero())
+				Expect(spec.Steps[1].Attempts).To(Equal(5))
+				Expect(spec.Steps[1].Backoff).To(Equal(10 * time.Second))
+				Expect(spec.Steps[2].Attempts).To(BeZero())
+			})
+		})
+
+		Context("when the number of attempts is invalid", func() {
+			BeforeEach(func() {
+				specContents = []byte(`RUN ./some-command
+RETRY 0`)
+			})
+
+			It("returns an error", func() {
+				_, err := Parse("ShakeAndBakeFile", specContents, Options{})
+				Expect(err).To(MatchError(`ShakeAndBakeFile:2:1: invalid number of attempts "0"`))
+			})
+		})
+
+		Context("when the backoff is invalid", func() {
+			BeforeEach(func() {
+				specContents = []byte(`RUN ./some-command
+RETRY 3 soon`)
+			})
+
+			It("returns an error", func() {
+				_, err := Parse("ShakeAndBakeFile", specContents, Options{})
+				Expect(err).To(MatchError(`ShakeAndBakeFile:2:1: invalid backoff "soon"`))
+			})
+		})
+
+		Context("when steps declare cache policies", func() {
+			BeforeEach(func() {
+				specContents = []byte(`RUN ./some-command 1
+CACHE always
+
+RUN ./some-command 2
+CACHE never
+
+RUN ./some-command 3
+CACHE ttl=24h
+
+RUN ./some-command 4
+CACHE ALWAYS ttl=30m
+
+RUN ./some-command 5`)
+			})
+
+			It("returns the policies of the steps", func() {
+				spec, err := Parse("ShakeAndBakeFile", specContents, Options{})
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(spec.Steps[0].Cache).To(Equal(CacheAlways))
+				Expect(spec.Steps[1].Cache).To(Equal(CacheNever))
+				Expect(spec.Steps[2].Cache).To(BeEmpty())
+				Expect(spec.Steps[2].CacheTTL).To(Equal(24 * time.Hour))
+				Expect(spec.Steps[3].Cache).To(Equal(CacheAlways))
+				Expect(spec.Steps[3].CacheTTL).To(Equal(30 * time.Minute))
+				Expect(spec.Steps[4].Cache).To(BeEmpty())
+				Expect(spec.Steps[4].CacheTTL).To(BeZero())
+			})
+		})
+
+		Context("when a cache policy is invalid", func() {
+			BeforeEach(func() {
+				specContents = []byte(`RUN ./some-command
+CACHE sometimes`)
+			})
+
+			It("returns an error", func() {
+				_, err := Parse("ShakeAndBakeFile", specContents, Options{})
+				Expect(err).To(MatchError(`ShakeAndBakeFile:2:1: invalid cache policy "sometimes"`))
+			})
+		})
+
+		Context("when a step that is never cached has a cache ttl", func() {
+			BeforeEach(func() {
+				specContents = []byte(`RUN ./some-command
+CACHE never ttl=1h`)
+			})
+
+			It("returns an error", func() {
+				_, err := Parse("ShakeAndBakeFile", specContents, Options{})
+				Expect(err).To(MatchError(`ShakeAndBakeFile:2:1: a step that is never cached cannot have a cache ttl`))
+			})
+		})
+
+		Context("when templates are called", func() {
+			BeforeEach(func() {
+				specContents = []byte(`DEFINE test(service, flags)
+  RUN go test ${flags} ./${service}/...
+  NAME test-${service}
+  INPUTS ${service}
+END
+
+CALL test(api, -race)
+CALL test(web, "-run 'A, B'")
+CALL test(web-legacy, "")`)
+			})
+
+			It("declares the steps of the template for every call", func() {
+				spec, err := Parse("ShakeAndBakeFile", specContents, Options{})
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(len(spec.Steps)).To(Equal(3))
+				Expect(spec.Steps[0].Name).To(Equal("test-api"))
+				Expect(spec.Steps[0].Command).To(Equal("go test -race ./api/..."))
+				Expect(spec.Steps[0].Inputs).To(Equal([]string{"api"}))
+				Expect(spec.Steps[1].Name).To(Equal("test-web"))
+				Expect(spec.Steps[1].Command).To(Equal("go test -run 'A, B' ./web/..."))
+				Expect(spec.Steps[2].Command).To(Equal("go test  ./web-legacy/..."))
+			})
+
+			It("includes the arguments in the definition of the steps", func() {
+				spec, err := Parse("ShakeAndBakeFile", specContents, Options{})
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(spec.Steps[0].Definition()).To(ContainSubstring("CALL test(service=api, flags=-race)"))
+			})
+		})
+
+		Context("when a template is called with the wrong number of arguments", func() {
+			BeforeEach(func() {
+				specContents = []byte(`DEFINE test(service)
+  RUN go test ./${service}/...
+END
+
+CALL test(api, web)`)
+			})
+
+			It("returns an error with the positions of the call and the definition", func() {
+				_, err := Parse("ShakeAndBakeFile", specContents, Options{})
+				Expect(err).To(MatchError(`ShakeAndBakeFile:5:1: template "test" defined at ShakeAndBakeFile:1:1 takes 1 arguments, but is called with 2`))
+			})
+		})
+
+		Context("when a template declares an invalid step", func() {
+			BeforeEach(func() {
+				specContents = []byte(`DEFINE test(service)
+  RUN go test ./${service}/...
+  NAME test ${service}
+END
+
+CALL test(api)`)
+			})
+
+			It("returns an error with the positions of the definition and the call", func() {
+				_, err := Parse("ShakeAndBakeFile", specContents, Options{})
+				Expect(err).To(MatchError(`ShakeAndBakeFile:3:3: invalid step name "test api" (in test called at ShakeAndBakeFile:6:1)`))
+			})
+		})
+
+		Context("when an unknown template is called", func() {
+			BeforeEach(func() {
+				specContents = []byte(`RUN ./some-command
+CALL test(api)`)
+			})
+
+			It("returns an error", func() {
+				_, err := Parse("ShakeAndBakeFile", specContents, Options{})
+				Expect(err).To(MatchError(`ShakeAndBakeFile:2:1: no template named "test"`))
+			})
+		})
+
+		Context("when a template calls itself", func() {
+			BeforeEach(func() {
+				specContents = []byte(`DEFINE test(service)
+  RUN go test ./${service}/...
+  CALL test(${service})
+END
+
+CALL test(api)`)
+			})
+
+			It("returns an error", func() {
+				_, err := Parse("ShakeAndBakeFile", specContents, Options{})
+				Expect(err).To(MatchError(`ShakeAndBakeFile:3:3: template "test" defined at ShakeAndBakeFile:1:1 calls itself (in test called at ShakeAndBakeFile:6:1)`))
+			})
+		})
+
+		Context("when cleanup steps are declared", func() {
+			BeforeEach(func() {
+				specContents = []byte(`RUN ./start-server.sh
+
+FINALLY
+  RUN ./stop-server.sh
+  NAME stop
+END
+
+on failure
+  RUN ./collect-logs.sh
+  TIMEOUT 1m
+END
+
+RUN ./test.sh`)
+			})
+
+			It("returns them apart from the other steps", func() {
+				spec, err := Parse("ShakeAndBakeFile", specContents, Options{})
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(len(spec.Steps)).To(Equal(2))
+				Expect(spec.Steps[0].Command).To(Equal("./start-server.sh"))
+				Expect(spec.Steps[1].Command).To(Equal("./test.sh"))
+
+				Expect(len(spec.Finally)).To(Equal(1))
+				Expect(spec.Finally[0].Command).To(Equal("./stop-server.sh"))
+				Expect(spec.Finally[0].Name).To(Equal("stop"))
+
+				Expect(len(spec.OnFailure)).To(Equal(1))
+				Expect(spec.OnFailure[0].Command).To(Equal("./collect-logs.sh"))
+				Expect(spec.OnFailure[0].Timeout).To(Equal(time.Minute))
+			})
+		})
+
+		Context("when a cleanup step declares its dependencies", func() {
+			BeforeEach(func() {
+				specContents = []byte(`RUN ./start-server.sh
+NAME start
+
+FINALLY
+  RUN ./stop-server.sh
+  AFTER start
+END`)
+			})
+
+			It("returns an error", func() {
+				_, err := Parse("ShakeAndBakeFile", specContents, Options{})
+				Expect(err).To(MatchError(`ShakeAndBakeFile:6:3: AFTER cannot be declared by a cleanup step`))
+			})
+		})
+
+		Context("when a cleanup block is not for failures", func() {
+			BeforeEach(func() {
+				specContents = []byte(`RUN ./start-server.sh
+
+ON SUCCESS
+  RUN ./stop-server.sh
+END`)
+			})
+
+			It("returns an error", func() {
+				_, err := Parse("ShakeAndBakeFile", specContents, Options{})
+				Expect(err).To(MatchError(`ShakeAndBakeFile:3:1: ON requires FAILURE`))
+			})
+		})
+
+		Context("when cleanup blocks are nested", func() {
+			BeforeEach(func() {
+				specContents = []byte(`RUN ./start-server.sh
+
+FINALLY
+  ON FAILURE
+    RUN ./stop-server.sh
+  END
+END`)
+			})
+
+			It("returns an error", func() {
+				_, err := Parse("ShakeAndBakeFile", specContents, Options{})
+				Expect(err).To(MatchError(`ShakeAndBakeFile:4:3: cleanup blocks cannot be nested`))
+			})
+		})
+
+		Context("when steps are grouped into stages", func() {
+			BeforeEach(func() {
+				specContents = []byte(`
+RUN ./fetch-deps.sh
+
+STAGE build
+RUN make build
+
+stage docs
+RUN make docs
+
+STAGE release after build
+RUN make package
+RUN make publish
+`)
+			})
+
+			It("records the stage of every step", func() {
+				spec, err := Parse("ShakeAndBakeFile", specContents, Options{})
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(spec.Stages).To(Equal([]Stage{
+					{Name: "build", Pos: Position{File: "ShakeAndBakeFile", Line: 4, Column: 1}},
+					{Name: "docs", Pos: Position{File: "ShakeAndBakeFile", Line: 7, Column: 1}},
+					{Name: "release", After: []string{"build"}, Pos: Position{File: "ShakeAndBakeFile", Line: 10, Column: 1}},
+				}))
+
+				var stages []string
+				for _, step := range spec.Steps {
+					stages = append(stages, step.Stage)
+				}
+				Expect(stages).To(Equal([]string{"", "build", "docs", "release", "release"}))
+			})
+
+			It("selects the steps needed for a target stage", func() {
+				spec, err := Parse("ShakeAndBakeFile", specContents, Options{})
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(spec.Target("release")).To(Equal([]int{0, 1, 3, 4}))
+				Expect(spec.Target("docs")).To(Equal([]int{0, 2}))
+
+				_, err = spec.Target("deploy")
+				Expect(err).To(MatchError(`no stage named "deploy"`))
+			})
+
+			It("identifies the same command distinctly in every stage", func() {
+				spec, err := Parse("ShakeAndBakeFile", []byte("STAGE dev\nRUN make\n\nSTAGE release\nRUN make"), Options{})
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(spec.Steps[0].ID()).NotTo(Equal(spec.Steps[1].ID()))
+
+				unstaged, err := Parse("ShakeAndBakeFile", []byte("RUN make"), Options{})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(spec.Steps[0].ID()).NotTo(Equal(unstaged.Steps[0].ID()))
+			})
+		})
+
+		Context("when steps of stages declare their dependencies", func() {
+			BeforeEach(func() {
+				specContents = []byte(`
+STAGE build
+RUN make lint
+NAME lint
+RUN make build
+NAME compile
+AFTER lint
+
+STAGE docs
+RUN make docs
+
+STAGE release AFTER build
+RUN make package
+NAME package
+`)
+			})
+
+			It("depends the steps of a stage on the steps of the stages it runs after", func() {
+				spec, err := Parse("ShakeAndBakeFile", specContents, Options{})
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(spec.Needs(3)).To(Equal([]int{1, 0}))
+				Expect(spec.Needs(2)).To(BeEmpty())
+				Expect(spec.Target("release")).To(Equal([]int{0, 1, 3}))
+			})
+		})
+
+		Context("when a stage is declared incorrectly", func() {
+			It("returns an error when it has no name", func() {
+				_, err := Parse("ShakeAndBakeFile", []byte("STAGE\nRUN make"), Options{})
+				Expect(err).To(MatchError(`ShakeAndBakeFile:1:1: STAGE requires a name, optionally followed by AFTER and the stages it depends on`))
+			})
+
+			It("returns an error when AFTER is not followed by stages", func() {
+				_, err := Parse("ShakeAndBakeFile", []byte("STAGE release AFTER\nRUN make"), Options{})
+				Expect(err).To(MatchError(`ShakeAndBakeFile:1:1: STAGE requires a name, optionally followed by AFTER and the stages it depends on`))
+			})
+
+			It("returns an error when its name is invalid", func() {
+				_, err := Parse("ShakeAndBakeFile", []byte("STAGE -release\nRUN make"), Options{})
+				Expect(err).To(MatchError(`ShakeAndBakeFile:1:1: invalid stage name "-release"`))
+			})
+
+			It("returns an error when it is declared twice", func() {
+				_, err := Parse("ShakeAndBakeFile", []byte("STAGE build\nRUN make\nSTAGE build\nRUN make test"), Options{})
+				Expect(err).To(MatchError(`ShakeAndBakeFile:3:1: stage "build" is already declared at ShakeAndBakeFile:1:1`))
+			})
+
+			It("returns an error when it runs after a stage declared later", func() {
+				_, err := Parse("ShakeAndBakeFile", []byte("STAGE release AFTER build\nRUN make\nSTAGE build\nRUN make test"), Options{})
+				Expect(err).To(MatchError(`ShakeAndBakeFile:1:1: no stage named "build" is declared before stage "release"`))
+			})
+
+			It("returns an error when it is within a block", func() {
+				_, err := Parse("ShakeAndBakeFile", []byte("FOREACH os IN linux\n  STAGE build\n  RUN make\nEND"), Options{})
+				Expect(err).To(MatchError(`ShakeAndBakeFile:2:3: STAGE cannot be declared within a block`))
+			})
+		})
+
+		Context("when a stage separates a step from its clauses", func() {
+			BeforeEach(func() {
+				specContents = []byte("RUN make\nSTAGE build\nNAME compile")
+			})
+
+			It("returns an error", func() {
+				_, err := Parse("ShakeAndBakeFile", specContents, Options{})
+				Expect(err).To(MatchError(`ShakeAndBakeFile:3:1: NAME must follow a RUN directive`))
+			})
+		})
+
+		Context("when a heredoc has a quoted delimiter", func() {
+			BeforeEach(func() {
+				specContents = []byte("ENV OUT=dist\nRUN <<'EOF'\necho ${OUT} ${x:-default}\nEOF\nRUN <<EOF\necho ${OUT}\nEOF")
+			})
+
+			It("does not interpolate its body", func() {
+				spec, err := Parse("ShakeAndBakeFile", specContents, Options{})
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(spec.Steps[0].Command).To(Equal("echo ${OUT} ${x:-default}"))
+				Expect(spec.Steps[1].Command).To(Equal("echo dist"))
+			})
+		})
+
+		Context("when a template is defined within a block", func() {
+			It("returns an error", func() {
+				_, err := Parse("ShakeAndBakeFile", []byte("FOREACH os IN linux darwin\n  DEFINE u()\n    RUN make\n  END\nEND"), Options{})
+				Expect(err).To(MatchError(`ShakeAndBakeFile:2:3: DEFINE cannot be declared within a block`))
+
+				_, err = Parse("ShakeAndBakeFile", []byte("DEFINE t()\n  DEFINE u()\n    RUN make\n  END\nEND\nCALL t()"), Options{})
+				Expect(err).To(MatchError(`ShakeAndBakeFile:2:3: DEFINE cannot be declared within a block (in t called at ShakeAndBakeFile:6:1)`))
+			})
+		})
+
+		Context("when an unknown directive is indicated", func() {
+			BeforeEach(func() {
+				specContents = []byte(`RUN ./some-command 1
+
+  RUNN ./some-command 2`)
+			})
+
+			It("returns an error with the position of the directive", func() {
+				_, err := Parse("ShakeAndBakeFile", specContents, Options{})
+				Expect(err).To(MatchError(`ShakeAndBakeFile:3:3: unknown directive "RUNN"`))
+			})
+		})
+
+		Context("when there is stray text between steps", func() {
+			BeforeEach(func() {
+				specContents = []byte(`RUN ./some-command 1
+
+some stray text
+
+RUN ./some-command 2`)
+			})
+
+			It("returns an error with the position of the text", func() {
+				_, err := Parse("ShakeAndBakeFile", specContents, Options{})
+				Expect(err).To(MatchError(`ShakeAndBakeFile:3:1: unknown directive "some"`))
+			})
+		})
+
+		Context("when a step has no command", func() {
+			BeforeEach(func() {
+				specContents = []byte(`RUN ./some-command 1
+
+RUN   `)
+			})
+
+			It("returns an error", func() {
+				_, err := Parse("ShakeAndBakeFile", specContents, Options{})
+				Expect(err).To(MatchError(`ShakeAndBakeFile:3:1: RUN requires a command`))
+			})
+		})
+
+		Context("when the spec is empty", func() {
+			BeforeEach(func() {
+				specContents = []byte("\n\n")
+			})
+
+			It("returns an error", func() {
+				_, err := Parse("ShakeAndBakeFile", specContents, Options{})
+				Expect(err).To(MatchError(`ShakeAndBakeFile:1:1: no RUN directives found`))
+			})
+		})
+	})
+
+	Describe("ParseYAML", func() {
+		var specContents []byte
+
+		Context("when steps are described", func() {
+			BeforeEach(func() {
+				specContents = []byte(`
+steps:
+  - name: lint
+    run: make lint
+  - name: build
+    run: |
+      go build \
+        -o bin/app
+
+      echo "built for $GOOS"
+    inputs: [src, go.mod]
+    outputs: [bin]
+    env:
+      GOOS: linux
+      OUT: ${GOOS}-bin
+    depends_on: [lint]
+    timeout: 10m
+  - run: make test
+`)
+			})
+
+			It("returns the same steps as the equivalent ShakeAndBakeFile", func() {
+				spec, err := ParseYAML("snb.yaml", specContents, Options{})
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(len(spec.Steps)).To(Equal(3))
+				Expect(spec.Steps[0].Name).To(Equal("lint"))
+				Expect(spec.Steps[0].Command).To(Equal("make lint"))
+				Expect(spec.Steps[0].Env).To(BeEmpty())
+
+				Expect(spec.Steps[1].Name).To(Equal("build"))
+				Expect(spec.Steps[1].Command).To(Equal("go build \\\n  -o bin/app\n\necho \"built for $GOOS\""))
+				Expect(spec.Steps[1].Inputs).To(Equal([]string{"src", "go.mod"}))
+				Expect(spec.Steps[1].Outputs).To(Equal([]string{"bin"}))
+				Expect(spec.Steps[1].Env).To(Equal([]string{"GOOS=linux", "OUT=linux-bin"}))
+				Expect(spec.Steps[1].After).To(Equal([]string{"lint"}))
+				Expect(spec.Steps[1].Timeout).To(Equal(10 * time.Minute))
+
+				Expect(spec.Steps[2].Command).To(Equal("make test"))
+				Expect(spec.Steps[2].Env).To(BeEmpty())
+				Expect(spec.Needs(2)).To(Equal([]int{1}))
+			})
+		})
+
+		Context("when a step depends on an unknown step", func() {
+			BeforeEach(func() {
+				specContents = []byte(`
+steps:
+  - run: make lint
+  - run: make build
+    depends_on: [lint]
+`)
+			})
+
+			It("returns an error locating the step", func() {
+				_, err := ParseYAML("snb.yaml", specContents, Options{})
+				Expect(err).To(MatchError(`snb.yaml:steps[1]: no step named "lint"`))
+			})
+		})
+
+		Context("when a step has no command", func() {
+			BeforeEach(func() {
+				specContents = []byte(`
+steps:
+  - name: lint
+`)
+			})
+
+			It("returns an error locating the step", func() {
+				_, err := ParseYAML("snb.yaml", specContents, Options{})
+				Expect(err).To(MatchError(`snb.yaml:steps[0]: run requires a command`))
+			})
+		})
+
+		Context("when a step has an unknown field", func() {
+			BeforeEach(func() {
+				specContents = []byte(`
+steps:
+  - run: make lint
+    command: make build
+`)
+			})
+
+			It("returns an error", func() {
+				_, err := ParseYAML("snb.yaml", specContents, Options{})
+				Expect(err).To(MatchError(ContainSubstring(`snb.yaml: yaml: unmarshal errors`)))
+				Expect(err).To(MatchError(ContainSubstring(`field command not found`)))
+			})
+		})
+
+		Context("when there are no steps", func() {
+			BeforeEach(func() {
+				specContents = []byte("steps: []\n")
+			})
+
+			It("returns an error", func() {
+				_, err := ParseYAML("snb.yaml", specContents, Options{})
+				Expect(err).To(MatchError(`snb.yaml: no steps found`))
+			})
+		})
+	})
+
+	Describe("Format", func() {
+		var specContents []byte
+
+		Context("when the spec is not in the canonical layout", func() {
+			BeforeEach(func() {
+				specContents = []byte(`
+# build the project
+run go build \
+        -o bin/app\
+  # explain the next line
+  ./cmd/app
+name build
+
+
+Run make test
+# wait for the build
+  after build
+foreach os IN linux darwin
+run echo ${os}
+	name build-${os}
+end
+on failure
+    RUN echo failed
+  # nothing else to do
+end
+run <<EOF
+  indented
+
+EOF
+RUN echo snb\
+fmt   \
+   done
+# trailing comment
+`)
+			})
+
+			It("renders it in the canonical layout", func() {
+				ast, err := ParseAST("ShakeAndBakeFile", specContents)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(string(Format(ast))).To(Equal(`# build the project
+# explain the next line
+RUN go build \
+    -o bin/app \
+    ./cmd/app
+NAME build
+
+RUN make test
+# wait for the build
+AFTER build
+
+FOREACH os IN linux darwin
+  RUN echo ${os}
+  NAME build-${os}
+END
+
+ON FAILURE
+  RUN echo failed
+  # nothing else to do
+END
+
+RUN <<EOF
+  indented
+
+EOF
+
+RUN echo snb\
+fmt \
+    done
+
+# trailing comment
+`))
+			})
+
+			It("renders the canonical layout unchanged", func() {
+				ast, err := ParseAST("ShakeAndBakeFile", specContents)
+				Expect(err).NotTo(HaveOccurred())
+				formatted := Format(ast)
+
+				ast, err = ParseAST("ShakeAndBakeFile", formatted)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(Format(ast))).To(Equal(string(formatted)))
+			})
+
+			It("does not change the steps of the spec or their identities", func() {
+				spec, err := Parse("ShakeAndBakeFile", specContents, Options{})
+				Expect(err).NotTo(HaveOccurred())
+
+				ast, err := ParseAST("ShakeAndBakeFile", specContents)
+				Expect(err).NotTo(HaveOccurred())
+
+				formattedSpec, err := Parse("ShakeAndBakeFile", Format(ast), Options{})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(formattedSpec.Steps).To(HaveLen(len(spec.Steps)))
+
+				// only the whitespace around the continued lines differs
+				continuation := regexp.MustCompile(`\s*\\\n\s*`)
+				for index, step := range spec.Steps {
+					Expect(continuation.ReplaceAllString(formattedSpec.Steps[index].Command, " ")).To(Equal(continuation.ReplaceAllString(step.Command, " ")))
+					Expect(formattedSpec.Steps[index].Name).To(Equal(step.Name))
+					Expect(formattedSpec.Steps[index].ID()).To(Equal(step.ID()))
+					Expect(formattedSpec.Steps[index].After).To(Equal(step.After))
+				}
+			})
+		})
+
+		Context("when a line is continued within quotes", func() {
+			BeforeEach(func() {
+				specContents = []byte("RUN echo \"[a \\\n   b]\" \\\n  'c  \\\n d'\n")
+			})
+
+			It("keeps the whitespace around the continuation as written", func() {
+				ast, err := ParseAST("ShakeAndBakeFile", specContents)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(string(Format(ast))).To(Equal("RUN echo \"[a \\\n   b]\" \\\n    'c  \\\n d'\n"))
+
+				spec, err := Parse("ShakeAndBakeFile", specContents, Options{})
+				Expect(err).NotTo(HaveOccurred())
+
+				formattedSpec, err := Parse("ShakeAndBakeFile", Format(ast), Options{})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(formattedSpec.Steps[0].Command).To(HavePrefix("echo \"[a \\\n   b]\""))
+				Expect(formattedSpec.Steps[0].Command).To(HaveSuffix("'c  \\\n d'"))
+				Expect(formattedSpec.Steps[0].Definition()).NotTo(Equal(spec.Steps[0].Definition()))
+			})
+		})
+
+		Context("when a heredoc strips leading tabs", func() {
+			BeforeEach(func() {
+				specContents = []byte("foreach os IN linux\n\trun <<-EOF\n\t\techo ${os}\n\t\tEOF\nend\n")
+			})
+
+			It("keeps its body and delimiter as written", func() {
+				ast, err := ParseAST("ShakeAndBakeFile", specContents)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(string(Format(ast))).To(Equal("FOREACH os IN linux\n  RUN <<-EOF\n\t\techo ${os}\n\t\tEOF\nEND\n"))
+
+				spec, err := Parse("ShakeAndBakeFile", Format(ast), Options{})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(spec.Steps[0].Command).To(Equal("echo linux"))
+			})
+		})
+
+		Context("when the spec declares stages", func() {
+			It("renders the keywords of their headers in upper case", func() {
+				ast, err := ParseAST("ShakeAndBakeFile", []byte("stage build\nrun make\nstage release after build\nrun make package\n"))
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(string(Format(ast))).To(Equal("STAGE build\nRUN make\n\nSTAGE release AFTER build\nRUN make package\n"))
+			})
+		})
+
+		Context("when the spec cannot be parsed", func() {
+			It("returns an error from ParseAST", func() {
+				_, err := ParseAST("ShakeAndBakeFile", []byte("RUN <<EOF\necho hi\n"))
+				Expect(err).To(MatchError(ContainSubstring(`heredoc is not terminated by EOF`)))
+			})
+		})
 	})
 })
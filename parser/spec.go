@@ -0,0 +1,664 @@
+package parser
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	namePattern     = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_./-]*$`)
+	variablePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+type Spec struct {
+	Steps []Step
+	// Stages are the ones declared with STAGE headers, in the order they
+	// are declared
+	Stages []Stage
+	// Finally are the steps executed at the end of every build, and
+	// OnFailure the ones executed beforehand when a step has failed
+	Finally   []Step
+	OnFailure []Step
+}
+
+// Stage groups the steps declared after its STAGE header, up to the next
+// one, so that they can be executed on their own
+type Stage struct {
+	Name string
+	// After names the stages that must have run before this one
+	After []string
+	// Pos is where the stage was declared
+	Pos Position
+}
+
+// Lookup returns the index of the step with the given name
+func (s Spec) Lookup(name string) (int, error) {
+	for index, step := range s.Steps {
+		if step.Name == name {
+			return index, nil
+		}
+	}
+
+	return 0, fmt.Errorf("no step named %q", name)
+}
+
+// builder interprets the nodes of a syntax tree into a Spec
+type builder struct {
+	spec     Spec
+	names    map[string]Position
+	commands map[string]int
+	// afters records where each step first declared its dependencies
+	afters map[int]Position
+	// env holds the variables declared so far, in KEY=value form
+	env       []string
+	buildArgs map[string]string
+	declared  map[string]bool
+	workDir   string
+	shell     []string
+	readFile  func(path string) ([]byte, error)
+	lookupEnv func(key string) (string, bool)
+	glob      func(pattern string) ([]string, error)
+	// bindings holds the variables of the FOREACH and DEFINE directives
+	// currently being expanded, innermost last
+	bindings []binding
+	// templates are the ones declared so far with DEFINE, and calls
+	// the ones currently being expanded
+	templates map[string]*template
+	calls     []string
+	// stages records where each stage was declared, and stage is the
+	// one that the steps declared so far belong to
+	stages map[string]Position
+	stage  string
+	// including holds the chain of files currently being applied, and
+	// source the checksum of the innermost one when it is included
+	including []string
+	source    string
+	// steps are the ones that RUN directives currently declare, which
+	// are those of a FINALLY or ON FAILURE block while it is applied.
+	// current is the index of the step among them that clauses such as
+	// NAME apply to, which must be declared in the same file.
+	steps   *[]Step
+	current int
+}
+
+func newBuilder(file string, opts Options) *builder {
+	readFile := opts.ReadFile
+	if readFile == nil {
+		readFile = ioutil.ReadFile
+	}
+
+	lookupEnv := opts.LookupEnv
+	if lookupEnv == nil {
+		lookupEnv = os.LookupEnv
+	}
+
+	glob := opts.Glob
+	if glob == nil {
+		glob = filepath.Glob
+	}
+
+	b := &builder{
+		names:     map[string]Position{},
+		commands:  map[string]int{},
+		afters:    map[int]Position{},
+		buildArgs: opts.BuildArgs,
+		declared:  map[string]bool{},
+		readFile:  readFile,
+		lookupEnv: lookupEnv,
+		glob:      glob,
+		including: []string{file},
+		templates: map[string]*template{},
+		stages:    map[string]Position{},
+		current:   -1,
+	}
+
+	b.steps = &b.spec.Steps
+	return b
+}
+
+func (b *builder) apply(node *Node) error {
+	if node.Args == "" && !bare[node.Directive] {
+		return errorf(node.Pos, "%s requires %s", node.Directive, argumentsFor(node.Directive))
+	}
+
+	value := b.expand(node.value())
+
+	switch node.Directive {
+	case directiveRun:
+		command := node.Args
+		if node.Heredoc {
+			command = node.Body
+		}
+
+		// as in the shell, the body of a heredoc with a quoted
+		// delimiter is left as written
+		if !node.quoted() {
+			command = b.expand(command)
+		}
+
+		if strings.TrimSpace(command) == "" {
+			return errorf(node.Pos, "%s requires %s", node.Directive, argumentsFor(node.Directive))
+		}
+
+		*b.steps = append(*b.steps, Step{
+			Command:    command,
+			Pos:        node.Pos,
+			Env:        append([]string(nil), b.env...),
+			WorkDir:    b.workDir,
+			Shell:      b.shell,
+			Call:       b.currentCall(),
+			Source:     b.source,
+			Stage:      b.stage,
+			occurrence: b.commands[normalizeCommand(command)],
+		})
+		b.commands[normalizeCommand(command)]++
+		b.current = len(*b.steps) - 1
+		return nil
+	case directiveEnv, directiveArg:
+		return b.applyVariables(node, value)
+	case directiveInclude:
+		return b.include(node, value)
+	case directiveForeach:
+		return b.foreach(node, value)
+	case directiveDefine:
+		return b.define(node, value)
+	case directiveCall:
+		return b.call(node, value)
+	case directiveStage:
+		return b.applyStage(node, value)
+	case directiveFinally:
+		return b.cleanup(node, &b.spec.Finally)
+	case directiveOn:
+		if strings.ToUpper(value) != "FAILURE" {
+			return errorf(node.Pos, "%s requires %s", node.Directive, argumentsFor(node.Directive))
+		}
+		return b.cleanup(node, &b.spec.OnFailure)
+	case directiveShell:
+		var shell []string
+		if err := json.Unmarshal([]byte(value), &shell); err != nil || len(shell) == 0 || shell[0] == "" {
+			return errorf(node.Pos, `%s requires %s, such as ["sh", "-c"]`, node.Directive, argumentsFor(node.Directive))
+		}
+
+		b.shell = shell
+		return nil
+	case directiveWorkDir:
+		// like the working directory of a shell, a relative path is
+		// relative to the one declared before it
+		if filepath.IsAbs(value) {
+			b.workDir = filepath.Clean(value)
+		} else {
+			b.workDir = filepath.Join(b.workDir, value)
+		}
+
+		if b.workDir == "." {
+			b.workDir = ""
+		}
+		return nil
+	}
+
+	if b.current == -1 {
+		return errorf(node.Pos, "%s must follow a %s directive", node.Directive, directiveRun)
+	}
+	step := &(*b.steps)[b.current]
+
+	switch node.Directive {
+	case directiveName:
+		name := value
+		// a name that does not vary with the items of the loops it is
+		// declared in is made distinct by the items instead
+		for _, binding := range b.bindings {
+			if binding.loop && !references(node.value(), binding.key) {
+				name += "-" + binding.value
+			}
+		}
+
+		if step.Name != "" {
+			return errorf(node.Pos, "step is already named %q", step.Name)
+		}
+
+		if !namePattern.MatchString(name) {
+			return errorf(node.Pos, "invalid step name %q", name)
+		}
+
+		if pos, ok := b.names[name]; ok {
+			return errorf(node.Pos, "step name %q is already declared at %s", name, pos)
+		}
+
+		b.names[name] = node.Pos
+		step.Name = name
+	case directiveInputs:
+		step.Inputs = append(step.Inputs, strings.Fields(value)...)
+	case directiveOutputs:
+		step.Outputs = append(step.Outputs, strings.Fields(value)...)
+	case directiveAfter:
+		if b.steps != &b.spec.Steps {
+			return errorf(node.Pos, "%s cannot be declared by a cleanup step", node.Directive)
+		}
+
+		if _, ok := b.afters[b.current]; !ok {
+			b.afters[b.current] = node.Pos
+		}
+		step.After = append(step.After, strings.Fields(value)...)
+	case directiveTimeout:
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout <= 0 {
+			return errorf(node.Pos, "invalid timeout %q", value)
+		}
+
+		step.Timeout = timeout
+	case directiveRetry:
+		return b.retry(node, step, value)
+	case directiveCache:
+		return b.cache(node, step, value)
+	}
+
+	return nil
+}
+
+// cleanup applies the directives of a FINALLY or ON FAILURE block,
+// declaring their steps as the given cleanup steps
+func (b *builder) cleanup(node *Node, steps *[]Step) error {
+	if b.steps != &b.spec.Steps {
+		return errorf(node.Pos, "cleanup blocks cannot be nested")
+	}
+
+	b.steps, b.current = steps, -1
+	defer func() {
+		b.steps, b.current = &b.spec.Steps, -1
+	}()
+
+	for _, child := range node.Nodes {
+		if err := b.apply(child); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// applyStage applies a STAGE header, which declares the stage that every
+// step following it belongs to, up to the next one
+func (b *builder) applyStage(node *Node, value string) error {
+	if b.nested() {
+		return errorf(node.Pos, "%s cannot be declared within a block", node.Directive)
+	}
+
+	words := strings.Fields(value)
+	if len(words) == 2 || len(words) > 2 && strings.ToUpper(words[1]) != directiveAfter {
+		return errorf(node.Pos, "%s requires %s", node.Directive, argumentsFor(node.Directive))
+	}
+
+	name := words[0]
+	if !namePattern.MatchString(name) {
+		return errorf(node.Pos, "invalid stage name %q", name)
+	}
+
+	if pos, ok := b.stages[name]; ok {
+		return errorf(node.Pos, "stage %q is already declared at %s", name, pos)
+	}
+
+	var after []string
+	if len(words) > 2 {
+		after = words[2:]
+	}
+
+	// the stages depended on are declared beforehand, which keeps
+	// them from forming a cycle
+	for _, dependency := range after {
+		if _, ok := b.stages[dependency]; !ok {
+			return errorf(node.Pos, "no stage named %q is declared before stage %q", dependency, name)
+		}
+	}
+
+	b.stages[name] = node.Pos
+	b.spec.Stages = append(b.spec.Stages, Stage{Name: name, After: after, Pos: node.Pos})
+	b.stage, b.current = name, -1
+	return nil
+}
+
+// nested reports whether the directives being applied are within a
+// FOREACH, DEFINE, FINALLY or ON FAILURE block
+func (b *builder) nested() bool {
+	return len(b.bindings) > 0 || len(b.calls) > 0 || b.steps != &b.spec.Steps
+}
+
+// retry applies a RETRY clause, which declares how many times a step is
+// attempted and how long to wait before the first retry
+func (b *builder) retry(node *Node, step *Step, value string) error {
+	words := strings.Fields(value)
+	if len(words) > 2 {
+		return errorf(node.Pos, "%s requires %s", node.Directive, argumentsFor(node.Directive))
+	}
+
+	attempts, err := strconv.Atoi(words[0])
+	if err != nil || attempts < 1 {
+		return errorf(node.Pos, "invalid number of attempts %q", words[0])
+	}
+
+	step.Attempts = attempts
+
+	if len(words) == 2 {
+		backoff, err := time.ParseDuration(words[1])
+		if err != nil || backoff < 0 {
+			return errorf(node.Pos, "invalid backoff %q", words[1])
+		}
+
+		step.Backoff = backoff
+	}
+
+	return nil
+}
+
+// cache applies a CACHE clause, which declares the policy that decides
+// whether a step is cached and optionally how long it stays cached for
+func (b *builder) cache(node *Node, step *Step, value string) error {
+	for _, word := range strings.Fields(value) {
+		switch policy := CachePolicy(strings.ToLower(word)); policy {
+		case CacheInputs, CacheAlways, CacheNever:
+			if step.Cache != "" {
+				return errorf(node.Pos, "cache policy is already %q", step.Cache)
+			}
+
+			step.Cache = policy
+		default:
+			if !strings.HasPrefix(string(policy), "ttl=") {
+				return errorf(node.Pos, "invalid cache policy %q", word)
+			}
+
+			ttl, err := time.ParseDuration(word[len("ttl="):])
+			if err != nil || ttl <= 0 {
+				return errorf(node.Pos, "invalid cache ttl %q", word)
+			}
+
+			step.CacheTTL = ttl
+		}
+	}
+
+	if step.Cache == CacheNever && step.CacheTTL > 0 {
+		return errorf(node.Pos, "a step that is never cached cannot have a cache ttl")
+	}
+
+	return nil
+}
+
+// include applies the directives of the spec file at the given path in
+// place of an INCLUDE directive
+func (b *builder) include(node *Node, name string) error {
+	path := name
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(filepath.Dir(node.Pos.File), path)
+	}
+
+	for index, file := range b.including {
+		if file == path {
+			chain := append(append([]string{}, b.including[index:]...), path)
+			return errorf(node.Pos, "include cycle: %s", strings.Join(chain, " -> "))
+		}
+	}
+
+	contents, err := b.readFile(path)
+	if err != nil {
+		return errorf(node.Pos, "cannot include %s: %s", name, err)
+	}
+
+	ast, err := ParseAST(path, contents)
+	if err != nil {
+		return err
+	}
+
+	previousSource, previousCurrent := b.source, b.current
+	b.source = fmt.Sprintf("%x", sha1.Sum(contents))
+	b.including = append(b.including, path)
+	b.current = -1
+
+	defer func() {
+		b.source, b.current = previousSource, previousCurrent
+		b.including = b.including[:len(b.including)-1]
+	}()
+
+	for _, node := range ast.Nodes {
+		if err := b.apply(node); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// binding is the variable of a FOREACH directive set to the item being
+// expanded, or a parameter of a template set to the argument it is
+// called with
+type binding struct {
+	key   string
+	value string
+	loop  bool
+}
+
+// foreach applies the nodes of a FOREACH directive once for every one of
+// its items, with its variable set to the item
+func (b *builder) foreach(node *Node, value string) error {
+	words := strings.Fields(value)
+	if len(words) < 3 || strings.ToUpper(words[1]) != "IN" {
+		return errorf(node.Pos, "%s requires %s", node.Directive, argumentsFor(node.Directive))
+	}
+
+	key := words[0]
+	if !variablePattern.MatchString(key) {
+		return errorf(node.Pos, "invalid variable name %q", key)
+	}
+
+	var items []string
+	for _, word := range words[2:] {
+		if !strings.ContainsAny(word, "*?[") {
+			items = append(items, word)
+			continue
+		}
+
+		matches, err := b.globItems(node, word)
+		if err != nil {
+			return err
+		}
+
+		items = append(items, matches...)
+	}
+
+	for _, item := range items {
+		b.bindings = append(b.bindings, binding{key: key, value: item, loop: true})
+		b.current = -1
+
+		for _, child := range node.Nodes {
+			if err := b.apply(child); err != nil {
+				return err
+			}
+		}
+
+		b.bindings = b.bindings[:len(b.bindings)-1]
+	}
+
+	// clauses cannot reach into the loop once it has ended
+	b.current = -1
+	return nil
+}
+
+// globItems returns the paths matching the pattern of a FOREACH
+// directive, relative to the working directory of the steps within it
+func (b *builder) globItems(node *Node, pattern string) ([]string, error) {
+	base := b.workDir
+	if !filepath.IsAbs(base) {
+		base = filepath.Join(filepath.Dir(node.Pos.File), base)
+	}
+
+	if filepath.IsAbs(pattern) {
+		base = ""
+	}
+
+	matches, err := b.glob(filepath.Join(base, pattern))
+	if err != nil {
+		return nil, errorf(node.Pos, "invalid pattern %q: %s", pattern, err)
+	}
+
+	if len(matches) == 0 {
+		return nil, errorf(node.Pos, "pattern %q does not match any paths", pattern)
+	}
+
+	var items []string
+	for _, match := range matches {
+		if base != "" {
+			match, err = filepath.Rel(base, match)
+			if err != nil {
+				return nil, errorf(node.Pos, "%s", err)
+			}
+		}
+
+		items = append(items, match)
+	}
+
+	return items, nil
+}
+
+// applyVariables declares the variables of an ENV or ARG directive for
+// every step that follows it
+func (b *builder) applyVariables(node *Node, value string) error {
+	words, err := splitWords(value)
+	if err != nil {
+		return errorf(node.Pos, "%s", err)
+	}
+
+	for _, word := range words {
+		var (
+			parts        = strings.SplitN(word, "=", 2)
+			key          = parts[0]
+			value        string
+			hasValue     = len(parts) == 2
+			buildArg, ok = b.buildArgs[key]
+		)
+
+		if !variablePattern.MatchString(key) {
+			return errorf(node.Pos, "invalid variable name %q", key)
+		}
+
+		if hasValue {
+			value = parts[1]
+		}
+
+		if node.Directive == directiveEnv && !hasValue {
+			return errorf(node.Pos, "%s requires KEY=value pairs", directiveEnv)
+		}
+
+		if node.Directive == directiveArg {
+			b.declared[key] = true
+
+			if ok {
+				value = buildArg
+			} else if !hasValue {
+				// an argument without a value leaves any inherited one in place
+				continue
+			}
+		}
+
+		b.setEnv(key, value)
+	}
+
+	return nil
+}
+
+func (b *builder) setEnv(key, value string) {
+	for index, entry := range b.env {
+		if strings.HasPrefix(entry, key+"=") {
+			b.env = append(b.env[:index], b.env[index+1:]...)
+			break
+		}
+	}
+
+	b.env = append(b.env, key+"="+value)
+}
+
+// finish validates everything that can only be known once every
+// directive of the spec has been applied
+func (b *builder) finish() error {
+	var undeclared []string
+	for key := range b.buildArgs {
+		if !b.declared[key] {
+			undeclared = append(undeclared, key)
+		}
+	}
+
+	if len(undeclared) > 0 {
+		sort.Strings(undeclared)
+		return fmt.Errorf("build arguments were not declared with %s: %s", directiveArg, strings.Join(undeclared, ", "))
+	}
+
+	for index, step := range b.spec.Steps {
+		for _, name := range step.After {
+			if _, ok := b.names[name]; !ok {
+				return errorf(b.afters[index], "no step named %q", name)
+			}
+
+			if name == step.Name {
+				return errorf(b.afters[index], "step %q cannot run after itself", name)
+			}
+		}
+	}
+
+	if cycle := b.spec.findCycle(); cycle != nil {
+		var names []string
+		for _, index := range cycle {
+			names = append(names, b.spec.Steps[index].String())
+		}
+
+		// a cycle can also pass through the dependencies of stages,
+		// which are not declared by the step itself
+		pos, ok := b.afters[cycle[0]]
+		if !ok {
+			pos = b.spec.Steps[cycle[0]].Pos
+		}
+
+		return errorf(pos, "dependency cycle: %s", strings.Join(names, " -> "))
+	}
+
+	return nil
+}
+
+func argumentsFor(directive string) string {
+	switch directive {
+	case directiveRun:
+		return "a command"
+	case directiveName:
+		return "a name"
+	case directiveAfter:
+		return "at least one step name"
+	case directiveEnv, directiveArg:
+		return "at least one variable"
+	case directiveWorkDir, directiveInclude:
+		return "a path"
+	case directiveShell:
+		return "a JSON array of strings"
+	case directiveForeach:
+		return "a variable, IN and at least one item"
+	case directiveTimeout:
+		return "a duration"
+	case directiveRetry:
+		return "a number of attempts and an optional backoff"
+	case directiveCache:
+		return "a policy"
+	case directiveDefine:
+		return "a name and parameters, such as build(service)"
+	case directiveCall:
+		return "a template and arguments, such as build(api)"
+	case directiveOn:
+		return "FAILURE"
+	case directiveStage:
+		return "a name, optionally followed by AFTER and the stages it depends on"
+	default:
+		return "at least one path"
+	}
+}
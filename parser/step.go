@@ -0,0 +1,179 @@
+package parser
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// CachePolicy decides whether a step that has run before is cached
+type CachePolicy string
+
+const (
+	// CacheInputs caches a step when its definition and the checksums
+	// of the files it references are unchanged, and is the default
+	CacheInputs CachePolicy = "inputs"
+	// CacheAlways caches a step when its definition is unchanged,
+	// regardless of the files it references
+	CacheAlways CachePolicy = "always"
+	// CacheNever executes a step every time
+	CacheNever CachePolicy = "never"
+)
+
+// DefaultShell executes the steps of a spec that does not declare a SHELL
+var DefaultShell = []string{"bash", "-c"}
+
+// spacedContinuation matches a line continuation along with the
+// whitespace around it
+var spacedContinuation = regexp.MustCompile(`\s*\\[ \t]*\n\s*`)
+
+// Step is a single unit of work declared in a spec
+type Step struct {
+	// Name optionally identifies the step in place of its command
+	Name string
+	// Command is the script handed to the shell
+	Command string
+	// Pos is where the step was declared
+	Pos Position
+	// Inputs are the paths or glob patterns the step reads from. When
+	// empty, inputs are guessed from the command itself.
+	Inputs []string
+	// Outputs are the paths or glob patterns the step writes to
+	Outputs []string
+	// After names the steps that must have run before this one
+	After []string
+	// Env holds the variables declared with ENV and ARG before the
+	// step, in KEY=value form
+	Env []string
+	// WorkDir is the directory the step executes in, relative to the
+	// directory of the spec unless absolute
+	WorkDir string
+	// Shell is the command the step is handed to as its last argument,
+	// or empty to use the DefaultShell
+	Shell []string
+	// Timeout is how long the step may execute for before it is
+	// terminated, or zero when it may execute indefinitely
+	Timeout time.Duration
+	// Attempts is how many times the step is executed until it
+	// succeeds, where zero means once. Backoff is how long to wait
+	// before the first retry, doubling before every one after it.
+	Attempts int
+	Backoff  time.Duration
+	// Cache is the policy the step is cached by, where empty means
+	// CacheInputs. A CacheTTL other than zero expires a cached run of
+	// the step once it is older than that.
+	Cache    CachePolicy
+	CacheTTL time.Duration
+	// Call is the call of the template declaring the step, with the
+	// arguments of every parameter, or empty when it is not declared
+	// by a template
+	Call string
+	// Source is the checksum of the included file declaring the step,
+	// or empty when the step is declared by the spec itself
+	Source string
+	// Stage is the name of the stage the step belongs to, or empty when
+	// it is declared before any STAGE header
+	Stage string
+
+	// occurrence counts the earlier steps of the spec sharing the
+	// same command, so that each of them has a distinct identity
+	occurrence int
+}
+
+// ID returns an identity for the step that is stable regardless of where
+// it is declared in the spec: its name when it has one, or otherwise a
+// hash of its command, the steps it is declared to run after and its
+// stage
+func (s Step) ID() string {
+	if s.Name != "" {
+		return s.Name
+	}
+
+	content := normalizeCommand(s.Command)
+	if len(s.After) > 0 {
+		content = fmt.Sprintf("%s\n%s %s", content, directiveAfter, strings.Join(s.After, " "))
+	}
+
+	if s.Stage != "" {
+		content = fmt.Sprintf("%s\n%s %s", content, directiveStage, s.Stage)
+	}
+
+	if s.occurrence > 0 {
+		content = fmt.Sprintf("%s\n#%d", content, s.occurrence)
+	}
+
+	return fmt.Sprintf("sha1:%x", sha1.Sum([]byte(content)))
+}
+
+// String returns a human readable title for the step
+func (s Step) String() string {
+	if s.Name != "" {
+		return s.Name
+	}
+
+	return s.Command
+}
+
+// Args returns the command line executing the step
+func (s Step) Args() []string {
+	shell := s.Shell
+	if len(shell) == 0 {
+		shell = DefaultShell
+	}
+
+	return append(append([]string(nil), shell...), s.Command)
+}
+
+// Definition returns everything about the step that, when changed,
+// should prevent a previous run from being reused
+func (s Step) Definition() string {
+	var definition = []string{s.Command}
+
+	if len(s.Inputs) > 0 {
+		definition = append(definition, directiveInputs+" "+strings.Join(s.Inputs, " "))
+	}
+
+	if len(s.Outputs) > 0 {
+		definition = append(definition, directiveOutputs+" "+strings.Join(s.Outputs, " "))
+	}
+
+	if s.WorkDir != "" {
+		definition = append(definition, directiveWorkDir+" "+s.WorkDir)
+	}
+
+	if len(s.Shell) > 0 {
+		shell, _ := json.Marshal(s.Shell)
+		definition = append(definition, directiveShell+" "+string(shell))
+	}
+
+	if s.Call != "" {
+		definition = append(definition, directiveCall+" "+s.Call)
+	}
+
+	if s.Source != "" {
+		definition = append(definition, directiveInclude+" "+s.Pos.File+" "+s.Source)
+	}
+
+	for _, variable := range s.Env {
+		definition = append(definition, directiveEnv+" "+variable)
+	}
+
+	return strings.Join(definition, "\n")
+}
+
+// normalizeCommand collapses the whitespace around the line continuations
+// of a command, so that reindenting the continued lines does not change
+// the identity of its step. A continuation without any
+// whitespace around it joins two parts of a word, as in the shell.
+func normalizeCommand(command string) string {
+	return spacedContinuation.ReplaceAllStringFunc(command, func(match string) string {
+		if match == "\\\n" {
+			return ""
+		}
+
+		return " "
+	})
+}
@@ -0,0 +1,160 @@
+package parser
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// signaturePattern matches the name of a template followed by its
+// parameters or arguments in parentheses, such as build(service, flags)
+var signaturePattern = regexp.MustCompile(`^([A-Za-z0-9][A-Za-z0-9_.-]*)\s*\((.*)\)$`)
+
+// template is a block of directives declared with DEFINE, which are
+// applied wherever it is called with CALL
+type template struct {
+	node   *Node
+	params []string
+}
+
+// define declares the template of a DEFINE directive. Templates are
+// only declared at the top level of a spec, as a block that is applied
+// more than once would otherwise declare them again.
+func (b *builder) define(node *Node, value string) error {
+	if b.nested() {
+		return errorf(node.Pos, "%s cannot be declared within a block", node.Directive)
+	}
+
+	groups := signaturePattern.FindStringSubmatch(value)
+	if groups == nil {
+		return errorf(node.Pos, "%s requires %s", node.Directive, argumentsFor(node.Directive))
+	}
+
+	name := groups[1]
+	if existing, ok := b.templates[name]; ok {
+		return errorf(node.Pos, "template %q is already defined at %s", name, existing.node.Pos)
+	}
+
+	params, err := splitArguments(groups[2])
+	if err != nil {
+		return errorf(node.Pos, "%s", err)
+	}
+
+	declared := map[string]bool{}
+	for _, param := range params {
+		if !variablePattern.MatchString(param) {
+			return errorf(node.Pos, "invalid parameter name %q", param)
+		}
+
+		if declared[param] {
+			return errorf(node.Pos, "parameter %q is declared twice", param)
+		}
+		declared[param] = true
+	}
+
+	b.templates[name] = &template{node: node, params: params}
+	return nil
+}
+
+// call applies the directives of the template named by a CALL directive,
+// with its parameters set to the arguments of the call
+func (b *builder) call(node *Node, value string) error {
+	groups := signaturePattern.FindStringSubmatch(value)
+	if groups == nil {
+		return errorf(node.Pos, "%s requires %s", node.Directive, argumentsFor(node.Directive))
+	}
+
+	name := groups[1]
+	tmpl, ok := b.templates[name]
+	if !ok {
+		return errorf(node.Pos, "no template named %q", name)
+	}
+
+	args, err := splitArguments(groups[2])
+	if err != nil {
+		return errorf(node.Pos, "%s", err)
+	}
+
+	if len(args) != len(tmpl.params) {
+		return errorf(node.Pos, "template %q defined at %s takes %d arguments, but is called with %d", name, tmpl.node.Pos, len(tmpl.params), len(args))
+	}
+
+	for _, call := range b.calls {
+		if strings.HasPrefix(call, name+"(") {
+			return errorf(node.Pos, "template %q defined at %s calls itself", name, tmpl.node.Pos)
+		}
+	}
+
+	var assignments []string
+	for index, param := range tmpl.params {
+		b.bindings = append(b.bindings, binding{key: param, value: args[index]})
+		assignments = append(assignments, param+"="+args[index])
+	}
+
+	b.calls = append(b.calls, fmt.Sprintf("%s(%s)", name, strings.Join(assignments, ", ")))
+	b.current = -1
+
+	defer func() {
+		b.bindings = b.bindings[:len(b.bindings)-len(tmpl.params)]
+		b.calls = b.calls[:len(b.calls)-1]
+		// clauses cannot reach into the template once it has been applied
+		b.current = -1
+	}()
+
+	for _, child := range tmpl.node.Nodes {
+		if err := b.apply(child); err != nil {
+			// the error is located within the definition, so the call
+			// site is needed to tell which of the calls caused it
+			if perr, ok := err.(*Error); ok {
+				return errorf(perr.Pos, "%s (in %s called at %s)", perr.Message, name, node.Pos)
+			}
+			return err
+		}
+	}
+
+	return nil
+}
+
+// currentCall describes the calls of the templates currently being
+// applied, along with their arguments
+func (b *builder) currentCall() string {
+	return strings.Join(b.calls, " ")
+}
+
+// splitArguments splits the comma separated parameters or arguments of a
+// signature, where quotes group an argument containing commas
+func splitArguments(text string) ([]string, error) {
+	if strings.TrimSpace(text) == "" {
+		return nil, nil
+	}
+
+	var (
+		args  []string
+		arg   strings.Builder
+		quote rune
+	)
+
+	for _, r := range text {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				arg.WriteRune(r)
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case r == ',':
+			args = append(args, strings.TrimSpace(arg.String()))
+			arg.Reset()
+		default:
+			arg.WriteRune(r)
+		}
+	}
+
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote", quote)
+	}
+
+	return append(args, strings.TrimSpace(arg.String())), nil
+}
@@ -0,0 +1,104 @@
+package parser
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// yamlSpec is the structure of a snb.yaml spec
+type yamlSpec struct {
+	Steps []yamlStep `yaml:"steps"`
+}
+
+type yamlStep struct {
+	Name      string            `yaml:"name"`
+	Run       string            `yaml:"run"`
+	Inputs    []string          `yaml:"inputs"`
+	Outputs   []string          `yaml:"outputs"`
+	Env       map[string]string `yaml:"env"`
+	DependsOn []string          `yaml:"depends_on"`
+	Timeout   string            `yaml:"timeout"`
+}
+
+// ParseYAML converts the contents of a snb.yaml spec into a Spec. Each
+// step is interpreted as the equivalent directives of a ShakeAndBakeFile,
+// except that its env only applies to the step itself. Errors locate the
+// step they occurred in, e.g. snb.yaml:steps[2].
+func ParseYAML(file string, specFile []byte, opts Options) (Spec, error) {
+	var spec yamlSpec
+	if err := yaml.UnmarshalStrict(specFile, &spec); err != nil {
+		return Spec{}, fmt.Errorf("%s: %s", file, err)
+	}
+
+	if len(spec.Steps) == 0 {
+		return Spec{}, fmt.Errorf("%s: no steps found", file)
+	}
+
+	b := newBuilder(file, opts)
+	for index, step := range spec.Steps {
+		pos := Position{File: file, Path: fmt.Sprintf("steps[%d]", index)}
+		if err := b.applyYAML(step, pos); err != nil {
+			return Spec{}, err
+		}
+	}
+
+	if err := b.finish(); err != nil {
+		return Spec{}, err
+	}
+
+	return b.spec, nil
+}
+
+// applyYAML declares a step of a snb.yaml spec by applying the nodes
+// that make up the same step in a ShakeAndBakeFile
+func (b *builder) applyYAML(step yamlStep, pos Position) error {
+	if strings.TrimSpace(step.Run) == "" {
+		return errorf(pos, "run requires a command")
+	}
+
+	env := b.env
+	defer func() { b.env = env }()
+	b.env = append([]string(nil), env...)
+
+	var keys []string
+	for key := range step.Env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if !variablePattern.MatchString(key) {
+			return errorf(pos, "invalid variable name %q", key)
+		}
+
+		b.setEnv(key, b.expand(step.Env[key]))
+	}
+
+	// the run of a step is used as written, like the body of a heredoc
+	run := strings.TrimRight(step.Run, "\n")
+	nodes := []*Node{{Directive: directiveRun, Args: run, Heredoc: true, Body: run}}
+
+	for _, clause := range []struct{ directive, value string }{
+		{directiveName, step.Name},
+		{directiveInputs, strings.Join(step.Inputs, " ")},
+		{directiveOutputs, strings.Join(step.Outputs, " ")},
+		{directiveAfter, strings.Join(step.DependsOn, " ")},
+		{directiveTimeout, step.Timeout},
+	} {
+		if clause.value != "" {
+			nodes = append(nodes, &Node{Directive: clause.directive, Args: clause.value})
+		}
+	}
+
+	for _, node := range nodes {
+		node.Pos = pos
+		if err := b.apply(node); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
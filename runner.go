@@ -0,0 +1,415 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/aemengo/snb/db"
+	"github.com/aemengo/snb/fs"
+	"github.com/aemengo/snb/parser"
+	"github.com/aemengo/snb/scheduler"
+	"github.com/fatih/color"
+)
+
+// killGracePeriod is how long a step that has timed out is given to exit
+// after SIGTERM before it is killed
+const killGracePeriod = 10 * time.Second
+
+// outputGracePeriod is how long the output of a step is still read once
+// it has exited, as processes it left running in the background may
+// hold on to its stdout and stderr indefinitely
+const outputGracePeriod = 100 * time.Millisecond
+
+// runner executes the selected steps of a spec, skipping the ones that
+// are cached
+type runner struct {
+	spec      parser.Spec
+	fsClient  *fs.FS
+	dbClient  *db.DB
+	indexes   []int
+	positions map[int]int
+	chain     bool
+	jobs      int
+	timeout   time.Duration
+
+	mutex    sync.Mutex
+	executed map[int]bool
+	// exports holds the variables exported by each step so far
+	exports map[int][]string
+}
+
+// stepFailure is returned when a step does not complete successfully
+type stepFailure struct {
+	step parser.Step
+	err  error
+}
+
+func (f *stepFailure) Error() string {
+	return f.err.Error()
+}
+
+// exitCode returns the exit status that the failure ends the build with
+func (f *stepFailure) exitCode() int {
+	if _, ok := f.err.(*timeoutError); ok {
+		return timeoutExitCode
+	}
+
+	if code, ok := exitCode(f.err); ok {
+		return code
+	}
+
+	return 1
+}
+
+// timeoutError is the reason a step fails when it is terminated for
+// exceeding its timeout
+type timeoutError struct {
+	timeout time.Duration
+}
+
+func (e *timeoutError) Error() string {
+	return fmt.Sprintf("timed out after %s", formatDuration(e.timeout))
+}
+
+// formatDuration renders a duration without its trailing zero units,
+// e.g. 10m rather than 10m0s
+func formatDuration(d time.Duration) string {
+	text := d.String()
+	if strings.HasSuffix(text, "m0s") {
+		text = strings.TrimSuffix(text, "0s")
+	}
+
+	if strings.HasSuffix(text, "h0m") {
+		text = strings.TrimSuffix(text, "0m")
+	}
+
+	return text
+}
+
+func newRunner(spec parser.Spec, fsClient *fs.FS, dbClient *db.DB, indexes []int, chain bool, jobs int, timeout time.Duration) *runner {
+	positions := map[int]int{}
+	for position, index := range indexes {
+		positions[index] = position
+	}
+
+	return &runner{
+		spec:      spec,
+		fsClient:  fsClient,
+		dbClient:  dbClient,
+		indexes:   indexes,
+		positions: positions,
+		chain:     chain,
+		jobs:      jobs,
+		timeout:   timeout,
+		executed:  map[int]bool{},
+		exports:   map[int][]string{},
+	}
+}
+
+func (r *runner) run() error {
+	return scheduler.Run(r.indexes, r.spec.Needs, r.jobs, r.runStep)
+}
+
+func (r *runner) runStep(index int) error {
+	out := newOutput(r.jobs > 1)
+	defer out.flush()
+
+	step := r.spec.Steps[index]
+
+	if _, ok := executing.signal(); ok {
+		return errInterrupted
+	}
+
+	// exported variables are part of the definition of the steps that
+	// receive them, so that a step runs again when they change
+	exports, err := r.exportsFor(r.spec.Dependencies(index))
+	if err != nil {
+		return err
+	}
+	step.Env = append(append([]string(nil), step.Env...), exports...)
+
+	title := step.String()
+	if len(step.Shell) > 0 {
+		title = fmt.Sprintf("%s (%s)", title, strings.Join(step.Shell, " "))
+	}
+	out.printf(boldWhite, "Step %d/%d : %s\n", r.positions[index]+1, len(r.indexes), title)
+
+	invalidatedBy := -1
+	if r.chain {
+		invalidatedBy = r.firstExecuted(r.spec.Dependencies(index))
+	}
+
+	srcFiles, err := r.fsClient.GetSrcFiles(step)
+	if err != nil {
+		return err
+	}
+
+	outputFiles, err := r.fsClient.GetOutputFiles(step)
+	if err != nil {
+		return err
+	}
+
+	objects := append(srcFiles, outputFiles...)
+	ok, err := r.dbClient.IsCached(step, objects)
+	if err != nil {
+		return err
+	}
+
+	if ok && invalidatedBy == -1 {
+		out.println(white, logPrefix+"Using cache")
+		return r.restoreExports(index, step)
+	}
+
+	if ok {
+		out.printf(white, logPrefix+"Invalidated by step %d\n", r.positions[invalidatedBy]+1)
+	}
+
+	// only a step that is executed again invalidates the steps that
+	// depend on it: not one that has never run, such as one just added
+	// to the spec, nor one that executes on every build because it
+	// cannot be cached
+	ran, err := r.dbClient.HasRun(step)
+	if err != nil {
+		return err
+	}
+
+	if ran && isCacheable(step, objects) {
+		r.mutex.Lock()
+		r.executed[index] = true
+		r.mutex.Unlock()
+	}
+
+	timeout := step.Timeout
+	if timeout == 0 {
+		timeout = r.timeout
+	}
+
+	exportFile, err := ioutil.TempFile("", "snb-export-")
+	if err != nil {
+		return err
+	}
+	exportFile.Close()
+	defer os.Remove(exportFile.Name())
+
+	execution := step
+	execution.Env = append(append([]string(nil), step.Env...), exportVariable+"="+exportFile.Name())
+
+	attempts, err := executeAttempts(execution, timeout, out)
+	if err != nil {
+		return &stepFailure{step: step, err: err}
+	}
+
+	exported, err := readExports(exportFile.Name())
+	if err != nil {
+		return err
+	}
+
+	// declared inputs are fingerprinted before the step runs, so that
+	// the step is free to modify them
+	if len(step.Inputs) == 0 {
+		srcFiles, err = r.fsClient.GetSrcFiles(step)
+		if err != nil {
+			return err
+		}
+	}
+
+	outputFiles, err = r.fsClient.GetOutputFiles(step)
+	if err != nil {
+		return err
+	}
+
+	for _, obj := range outputFiles {
+		if obj.Sha == "" {
+			return &stepFailure{step: step, err: fmt.Errorf("step did not produce declared output %s", obj.Path)}
+		}
+	}
+
+	err = r.dbClient.Save(step, append(srcFiles, outputFiles...))
+	if err != nil {
+		return err
+	}
+
+	err = r.dbClient.SaveExports(step, exported)
+	if err != nil {
+		return err
+	}
+
+	r.mutex.Lock()
+	r.exports[index] = exported
+	r.mutex.Unlock()
+
+	err = r.dbClient.RecordAttempts(step, attempts)
+	if err != nil || attempts == 1 {
+		return err
+	}
+
+	flakyRuns, err := r.dbClient.FlakyRuns(step)
+	if err != nil {
+		return err
+	}
+
+	out.printf(white, logPrefix+"Succeeded on attempt %d/%d (runs needing retries: %d)\n", attempts, step.Attempts, flakyRuns)
+	return nil
+}
+
+// firstExecuted returns the first of the given step indexes that was
+// executed during this build, or -1 if all of them were cached
+func (r *runner) firstExecuted(indexes []int) int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, index := range indexes {
+		if r.executed[index] {
+			return index
+		}
+	}
+
+	return -1
+}
+
+// isCacheable reports whether a step can be cached at all, given the
+// objects that it references
+func isCacheable(step parser.Step, objects []fs.Object) bool {
+	if step.Cache == parser.CacheNever {
+		return false
+	}
+
+	return step.Cache == parser.CacheAlways || len(objects) > 0
+}
+
+// executeAttempts executes a step until it succeeds or runs out of
+// attempts, returning the number of attempts made
+func executeAttempts(step parser.Step, timeout time.Duration, out *output) (int, error) {
+	if step.Attempts <= 1 {
+		out.println(white, logPrefix+"Running")
+		return 1, executeStep(step, timeout, out)
+	}
+
+	backoff := step.Backoff
+	for attempt := 1; ; attempt++ {
+		out.printf(white, logPrefix+"Running (attempt %d/%d)\n", attempt, step.Attempts)
+
+		err := executeStep(step, timeout, out)
+		if _, interrupted := executing.signal(); err == nil || attempt == step.Attempts || interrupted {
+			return attempt, err
+		}
+
+		out.printf(red, logPrefix+"Attempt %d/%d failed (%s)\n", attempt, step.Attempts, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// executeStep runs the command of a step to completion. When a timeout
+// is given and exceeded, the whole process group of the step is sent
+// SIGTERM, followed by SIGKILL if it has not exited after a grace period.
+func executeStep(step parser.Step, timeout time.Duration, out *output) error {
+	args := step.Args()
+	command := exec.Command(args[0], args[1:]...)
+	command.Dir = filepath.Join(workingDir, step.WorkDir)
+	if filepath.IsAbs(step.WorkDir) {
+		command.Dir = step.WorkDir
+	}
+
+	if err := os.MkdirAll(command.Dir, os.ModePerm); err != nil {
+		return err
+	}
+	command.Env = append(os.Environ(), step.Env...)
+	command.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	stdout, stdoutWriter, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+
+	stderr, stderrWriter, err := os.Pipe()
+	if err != nil {
+		stdout.Close()
+		stdoutWriter.Close()
+		return err
+	}
+
+	command.Stdout = stdoutWriter
+	command.Stderr = stderrWriter
+
+	err = command.Start()
+	stdoutWriter.Close()
+	stderrWriter.Close()
+	if err != nil {
+		stdout.Close()
+		stderr.Close()
+		return err
+	}
+
+	executing.add(command.Process.Pid)
+	defer executing.remove(command.Process.Pid)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go report(stdout, out, white, &wg)
+	go report(stderr, out, red, &wg)
+
+	done := make(chan error, 1)
+	go func() {
+		err := command.Wait()
+
+		reported := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(reported)
+		}()
+
+		select {
+		case <-reported:
+		case <-time.After(outputGracePeriod):
+		}
+
+		// closing the pipes stops reading the output of any process
+		// still holding on to them
+		stdout.Close()
+		stderr.Close()
+		<-reported
+
+		done <- err
+	}()
+
+	if timeout == 0 {
+		return <-done
+	}
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+	}
+
+	// the negative pid signals every process in the group of the step
+	syscall.Kill(-command.Process.Pid, syscall.SIGTERM)
+
+	select {
+	case <-done:
+	case <-time.After(killGracePeriod):
+		syscall.Kill(-command.Process.Pid, syscall.SIGKILL)
+		<-done
+	}
+
+	return &timeoutError{timeout: timeout}
+}
+
+func report(stdout io.ReadCloser, out *output, clr *color.Color, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		out.println(clr, scanner.Text())
+	}
+}
@@ -0,0 +1,73 @@
+package scheduler
+
+// Run executes a job for each of the given indexes, starting a job only
+// once every job it needs has completed and running at most limit jobs
+// at a time. Jobs are started in the order given whenever possible, and
+// needs outside of the given indexes are considered to be satisfied.
+//
+// Once a job fails no further jobs are started: Run waits for the ones
+// still running and returns the first error encountered.
+func Run(indexes []int, needs func(index int) []int, limit int, job func(index int) error) error {
+	type result struct {
+		index int
+		err   error
+	}
+
+	if limit < 1 {
+		limit = 1
+	}
+
+	var (
+		scheduled = map[int]bool{}
+		started   = map[int]bool{}
+		done      = map[int]bool{}
+		results   = make(chan result)
+		running   = 0
+		firstErr  error
+	)
+
+	for _, index := range indexes {
+		scheduled[index] = true
+	}
+
+	ready := func(index int) bool {
+		for _, need := range needs(index) {
+			if scheduled[need] && !done[need] {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	for {
+		for _, index := range indexes {
+			if firstErr != nil || running >= limit {
+				break
+			}
+
+			if started[index] || !ready(index) {
+				continue
+			}
+
+			started[index] = true
+			running++
+
+			go func(index int) {
+				results <- result{index: index, err: job(index)}
+			}(index)
+		}
+
+		if running == 0 {
+			return firstErr
+		}
+
+		r := <-results
+		running--
+		done[r.index] = true
+
+		if r.err != nil && firstErr == nil {
+			firstErr = r.err
+		}
+	}
+}
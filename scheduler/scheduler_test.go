@@ -0,0 +1,122 @@
+package scheduler_test
+
+import (
+	. "github.com/aemengo/snb/scheduler"
+
+	"errors"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Scheduler", func() {
+	Describe("Run", func() {
+		var (
+			mutex     sync.Mutex
+			completed []int
+			running   int
+			maxRun    int
+			job       = func(index int) error {
+				mutex.Lock()
+				running++
+				if running > maxRun {
+					maxRun = running
+				}
+				mutex.Unlock()
+
+				time.Sleep(20 * time.Millisecond)
+
+				mutex.Lock()
+				defer mutex.Unlock()
+				running--
+				completed = append(completed, index)
+				return nil
+			}
+		)
+
+		BeforeEach(func() {
+			completed = nil
+			running = 0
+			maxRun = 0
+		})
+
+		Context("when the jobs depend on each other in sequence", func() {
+			It("runs them one at a time in order", func() {
+				needs := func(index int) []int {
+					if index == 0 {
+						return nil
+					}
+					return []int{index - 1}
+				}
+
+				err := Run([]int{0, 1, 2}, needs, 4, job)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(completed).To(Equal([]int{0, 1, 2}))
+				Expect(maxRun).To(Equal(1))
+			})
+		})
+
+		Context("when the jobs are independent", func() {
+			It("runs them concurrently up to the limit", func() {
+				needs := func(index int) []int { return nil }
+
+				err := Run([]int{0, 1, 2, 3}, needs, 2, job)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(completed).To(ConsistOf(0, 1, 2, 3))
+				Expect(maxRun).To(Equal(2))
+			})
+		})
+
+		Context("when a job depends on several others", func() {
+			It("runs it once all of them have completed", func() {
+				needs := func(index int) []int {
+					if index == 2 {
+						return []int{0, 1}
+					}
+					return nil
+				}
+
+				err := Run([]int{0, 1, 2}, needs, 4, job)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(completed).To(HaveLen(3))
+				Expect(completed[2]).To(Equal(2))
+			})
+		})
+
+		Context("when a job needs one that was not given", func() {
+			It("considers it satisfied", func() {
+				needs := func(index int) []int { return []int{0} }
+
+				err := Run([]int{1}, needs, 1, job)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(completed).To(Equal([]int{1}))
+			})
+		})
+
+		Context("when a job fails", func() {
+			It("starts no further jobs and returns the error", func() {
+				needs := func(index int) []int {
+					if index == 0 {
+						return nil
+					}
+					return []int{index - 1}
+				}
+
+				err := Run([]int{0, 1, 2}, needs, 1, func(index int) error {
+					job(index)
+					if index == 1 {
+						return errors.New("some-error")
+					}
+					return nil
+				})
+				Expect(err).To(MatchError("some-error"))
+				Expect(completed).To(Equal([]int{0, 1}))
+			})
+		})
+	})
+})
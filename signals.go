@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// errInterrupted is returned for the steps that are not started once
+// snb has received a signal
+var errInterrupted = errors.New("interrupted")
+
+// processGroups holds the process groups of the steps executing. Every
+// step executes in a process group of its own, so the signals that snb
+// receives from the terminal have to be passed on to them.
+type processGroups struct {
+	mutex    sync.Mutex
+	pgids    map[int]bool
+	received os.Signal
+}
+
+var executing = &processGroups{pgids: map[int]bool{}}
+
+func (p *processGroups) add(pgid int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.pgids[pgid] = true
+}
+
+func (p *processGroups) remove(pgid int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	delete(p.pgids, pgid)
+}
+
+// forward passes every SIGINT and SIGTERM that snb receives on to the
+// steps executing at the time, cleanup steps included
+func (p *processGroups) forward() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		for sig := range signals {
+			p.mutex.Lock()
+			p.received = sig
+			for pgid := range p.pgids {
+				syscall.Kill(-pgid, sig.(syscall.Signal))
+			}
+			p.mutex.Unlock()
+		}
+	}()
+}
+
+// signal returns the last signal snb has received, if any
+func (p *processGroups) signal() (syscall.Signal, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	sig, ok := p.received.(syscall.Signal)
+	return sig, ok
+}